@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(agentCmd)
+	skipInventory(agentCmd)
+	af := agentCmd.Flags()
+	af.StringVar(&agentManifest, `manifest`, ``, `Directory or HTTP(S) URL where the manifest is published`)
+	af.StringVar(&agentInstance, `instance`, ``, `Name of this instance in the manifest (default: the hostname)`)
+	af.StringSliceVar(&agentTrustedKeys, `trusted-key`, nil, `Public key trusted to sign the manifest`)
+	af.BoolVar(&agentInsecure, `insecure`, false, `Accept an unsigned manifest when no trusted keys are given`)
+	af.StringVar(&agentStatus, `status`, ``, `Directory or HTTP(S) URL for status reports (default: the manifest)`)
+	af.StringVar(&agentState, `state`, agentState, `File where the time of the last manifest applied is kept`)
+	af.DurationVar(&agentInterval, `interval`, time.Minute, `Time between polls of the manifest`)
+	af.BoolVar(&agentOnce, `once`, false, `Poll the manifest once and exit`)
+
+	deployCmd.Flags().BoolVar(
+		&deployViaAgent, `via-agent`, false, `Push systems to stores and publish a manifest for agents to deploy`)
+	deployCmd.Flags().StringVar(
+		&deployManifest, `manifest`, ``, `Directory or HTTP(S) URL where the manifest is published, with --via-agent`)
+}
+
+var agentCmd = &cobra.Command{
+	Use:   `agent`,
+	Short: `Deploys the system for this instance from a manifest`,
+	Long: `Agent runs on an instance, and polls a manifest published by "nix-hive deploy --via-agent" for the system
+the instance should be running.  When that changes, the agent realises the system from the instance's substituters,
+activates it and reports its status next to the manifest.  See <hive/agent.nix> for a NixOS module that runs it.
+
+The agent remembers when the last manifest it applied was generated, and refuses older manifests, so that a manifest
+that was replaced cannot be published again to roll the instance back.`,
+	RunE: runAgent,
+}
+
+var agentManifest = ``
+var agentInstance = ``
+var agentTrustedKeys []string
+var agentInsecure = false
+var agentStatus = ``
+var agentState = `/var/lib/nix-hive-agent/generated`
+var agentInterval = time.Minute
+var agentOnce = false
+var deployViaAgent = false
+var deployManifest = ``
+
+// agentProfile is the system profile that the agent updates, like nixos-rebuild.
+const agentProfile = `/nix/var/nix/profiles/system`
+
+func runAgent(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	if agentManifest == `` {
+		return fmt.Errorf(`agent requires a --manifest`)
+	}
+	if len(agentTrustedKeys) == 0 && !agentInsecure {
+		return fmt.Errorf(`agent requires a --trusted-key, or --insecure to accept an unsigned manifest`)
+	}
+	if agentInstance == `` {
+		name, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		agentInstance = name
+	}
+	if agentStatus == `` {
+		agentStatus = agentManifest
+	}
+	for {
+		err := agentPoll(ctx)
+		if err != nil {
+			warn(ctx, `%v`, err)
+		}
+		if agentOnce {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(agentInterval):
+		}
+	}
+}
+
+// agentPoll checks the manifest once, deploying the system for the instance if it has changed.
+func agentPoll(ctx context.Context) error {
+	manifest, entry, err := agentFetch(ctx)
+	if err != nil {
+		return err
+	}
+	last, err := agentLastApplied()
+	if err != nil {
+		return err
+	}
+	current, _ := os.Readlink(`/run/current-system`)
+	switch {
+	case entry.Path != current:
+	case manifest.Generated.After(last):
+		// already running the right system, but older manifests must still be refused from now on.
+		return agentSetLastApplied(manifest.Generated)
+	default:
+		return nil // already running the right system.
+	}
+	if !manifest.Generated.After(last) {
+		return fmt.Errorf(`the manifest was generated at %v, which is not after the last manifest applied at %v`,
+			manifest.Generated.Format(time.RFC3339), last.Format(time.RFC3339))
+	}
+	status := AgentStatus{Instance: agentInstance, Path: entry.Path, Current: current, State: `deploying`}
+	agentReport(ctx, status)
+	err = agentDeploy(ctx, entry.Path)
+	status.Current, _ = os.Readlink(`/run/current-system`)
+	status.State = `active`
+	if err == nil {
+		err = agentSetLastApplied(manifest.Generated)
+	}
+	if err != nil {
+		status.State, status.Error = `failed`, err.Error()
+	}
+	agentReport(ctx, status)
+	return err
+}
+
+// agentFetch fetches and verifies the manifest, returning it and the entry for the instance.
+func agentFetch(ctx context.Context) (*Manifest, *ManifestEntry, error) {
+	data, err := fetchResource(ctx, agentManifest, `manifest.json`)
+	if err != nil {
+		return nil, nil, fmt.Errorf(`%w while fetching the manifest`, err)
+	}
+	if len(agentTrustedKeys) > 0 {
+		sig, err := fetchResource(ctx, agentManifest, `manifest.json.sig`)
+		if err != nil {
+			return nil, nil, fmt.Errorf(`%w while fetching the manifest signature`, err)
+		}
+		err = verifyManifest(agentTrustedKeys, data, string(sig))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	var manifest Manifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, nil, fmt.Errorf(`%w while reading the manifest`, err)
+	}
+	entry, ok := manifest.Instances[agentInstance]
+	if !ok {
+		return nil, nil, fmt.Errorf(`the manifest has no system for %q`, agentInstance)
+	}
+	return &manifest, &entry, nil
+}
+
+// agentLastApplied returns the time the last manifest applied by the agent was generated, or the zero time if it has
+// not applied one.
+func agentLastApplied() (time.Time, error) {
+	data, err := ioutil.ReadFile(agentState)
+	switch {
+	case err == nil:
+	case os.IsNotExist(err):
+		return time.Time{}, nil
+	default:
+		return time.Time{}, err
+	}
+	last, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf(`%w while reading %v`, err, agentState)
+	}
+	return last, nil
+}
+
+// agentSetLastApplied records the time the manifest that was applied was generated.
+func agentSetLastApplied(generated time.Time) error {
+	err := os.MkdirAll(filepath.Dir(agentState), 0700)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(agentState+`.tmp`, []byte(generated.Format(time.RFC3339Nano)+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(agentState+`.tmp`, agentState)
+}
+
+// agentDeploy realises a system from the configured substituters, and activates it like nixos-rebuild switch.
+func agentDeploy(ctx context.Context, path string) error {
+	inform(ctx, `deploying %v`, path)
+	for _, args := range [][]string{
+		{`nix-store`, `--realise`, path},
+		{`nix-env`, `--profile`, agentProfile, `--set`, path},
+		{path + `/bin/switch-to-configuration`, `switch`},
+	} {
+		proc := exec.CommandContext(ctx, args[0], args[1:]...)
+		proc.Stdout = os.Stderr
+		proc.Stderr = os.Stderr
+		err := proc.Run()
+		if err != nil {
+			return fmt.Errorf(`%w while running %v`, err, args[0])
+		}
+	}
+	return nil
+}
+
+// agentReport reports the status of the instance, warning if it cannot.
+func agentReport(ctx context.Context, status AgentStatus) {
+	status.Time = time.Now().UTC()
+	data, err := json.MarshalIndent(&status, ``, `  `)
+	if err == nil {
+		err = storeResource(ctx, agentStatus, `status/`+agentInstance+`.json`, append(data, '\n'))
+	}
+	if err != nil {
+		warn(ctx, `%v while reporting status`, err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// A RunResult describes the instances where a command had the same output and exit status, as written by
+// "run --aggregate --json".
+type RunResult struct {
+	Instances []string `json:"instances"`
+	Exit      int      `json:"exit"`
+	Stdout    string   `json:"stdout"`
+	Stderr    string   `json:"stderr"`
+
+	// Error describes why the command could not be run, if it did not run at all.
+	Error string `json:"error,omitempty"`
+}
+
+// aggregateResults groups the captured outputs with the same stdout, stderr and exit status, largest groups first.
+func aggregateResults(outputs []*runOutput) []*RunResult {
+	groups := make(map[string]*RunResult)
+	var results []*RunResult
+	for _, out := range outputs {
+		if out == nil {
+			continue // skipped by --fail-fast.
+		}
+		item := RunResult{
+			Stdout: out.captured[0].String(),
+			Stderr: out.captured[1].String(),
+		}
+		var exit *exec.ExitError
+		switch {
+		case out.err == nil:
+		case errors.As(out.err, &exit):
+			item.Exit = exit.ExitCode()
+		default:
+			item.Exit, item.Error = -1, out.err.Error()
+		}
+		key := fmt.Sprintf("%v\x00%v\x00%v\x00%v", item.Exit, item.Error, item.Stdout, item.Stderr)
+		group, ok := groups[key]
+		if !ok {
+			group = &item
+			groups[key] = group
+			results = append(results, group)
+		}
+		group.Instances = append(group.Instances, out.instance)
+	}
+	for _, group := range results {
+		sort.Strings(group.Instances)
+	}
+	sort.SliceStable(results, func(i, j int) bool { return len(results[i].Instances) > len(results[j].Instances) })
+	return results
+}
+
+// writeAggregate writes grouped results as text, or as JSON with --json.
+func writeAggregate(w io.Writer, results []*RunResult) error {
+	if runJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent(``, `  `)
+		return enc.Encode(results)
+	}
+	for _, group := range results {
+		fmt.Fprintf(w, "## %v (%v)\n", strings.Join(group.Instances, `, `), len(group.Instances))
+		switch {
+		case group.Error != ``:
+			fmt.Fprintf(w, "!! %v\n", group.Error)
+		case group.Exit != 0:
+			fmt.Fprintf(w, "!! exit status %v\n", group.Exit)
+		}
+		writeBlock(w, ``, group.Stdout)
+		writeBlock(w, `stderr: `, group.Stderr)
+	}
+	return nil
+}
+
+// writeBlock writes text with a prefix on each line, ending it with a newline if it does not have one.
+func writeBlock(w io.Writer, prefix, text string) {
+	if text == `` {
+		return
+	}
+	for _, line := range strings.SplitAfter(strings.TrimSuffix(text, "\n"), "\n") {
+		fmt.Fprintf(w, "%v%v\n", prefix, strings.TrimSuffix(line, "\n"))
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+func init() {
+	rootCmd.PersistentFlags().BoolVar(
+		&allowOversize, `allow-oversize`, false, `Warn instead of failing when a system exceeds its maxClosureSize`)
+}
+
+var allowOversize = false
+
+// budgetBreakdown is the number of the largest paths listed when a system exceeds its closure size budget.
+const budgetBreakdown = 10
+
+// A ByteSize is a number of bytes, which may be written in JSON as a number, or a string like "2GiB".
+type ByteSize int64
+
+func (size *ByteSize) UnmarshalJSON(data []byte) error {
+	var text string
+	if json.Unmarshal(data, &text) != nil {
+		text = string(data)
+	}
+	n, err := parseBytes(text)
+	if err != nil {
+		return err
+	}
+	*size = ByteSize(n)
+	return nil
+}
+
+// checkBudget checks the closure of a system's result against its maxClosureSize and forbidden patterns.
+func (cfg *System) checkBudget(ctx context.Context, system, result string) error {
+	if cfg.MaxClosureSize == 0 && len(cfg.Forbidden) == 0 {
+		return nil
+	}
+	closure, err := closureInfo(ctx, result)
+	if err != nil {
+		return err
+	}
+	var forbidden []string
+	for _, info := range closure {
+		name := storePathName(info.Path)
+		pkg, _ := parseDrvName(name)
+		for _, pattern := range cfg.Forbidden {
+			hit, err := path.Match(pattern, name)
+			if err != nil {
+				return fmt.Errorf(`%v while parsing forbidden pattern %q`, err, pattern)
+			}
+			if hit || pattern == pkg {
+				forbidden = append(forbidden, info.Path)
+				break
+			}
+		}
+	}
+	if len(forbidden) > 0 {
+		return fmt.Errorf(`%q contains forbidden paths: %v`, system, strings.Join(forbidden, `, `))
+	}
+	if cfg.MaxClosureSize == 0 {
+		return nil
+	}
+	total := int64(0)
+	for _, info := range closure {
+		total += info.NarSize
+	}
+	if total <= int64(cfg.MaxClosureSize) {
+		return nil
+	}
+	sort.Slice(closure, func(i, j int) bool { return closure[i].NarSize > closure[j].NarSize })
+	if len(closure) > budgetBreakdown {
+		closure = closure[:budgetBreakdown]
+	}
+	warn(ctx, `the closure of %q is %v, which exceeds its maxClosureSize of %v; its largest paths are:`,
+		system, formatBytes(total), formatBytes(int64(cfg.MaxClosureSize)))
+	for _, info := range closure {
+		warn(ctx, `  %10v  %v`, formatBytes(info.NarSize), info.Path)
+	}
+	if allowOversize {
+		return nil
+	}
+	return fmt.Errorf(`the closure of %q exceeds its maxClosureSize by %v`,
+		system, formatBytes(total-int64(cfg.MaxClosureSize)))
+}
+
+// storePathName returns the name of a store path, without its directory and hash.
+func storePathName(path string) string {
+	base := path[strings.LastIndexByte(path, '/')+1:]
+	if ix := strings.IndexByte(base, '-'); ix != -1 {
+		return base[ix+1:]
+	}
+	return base
+}
+
+// parseDrvName splits a name like "openssl-1.1.1k-bin" into its package name and version the way Nix does, at the
+// first dash that is followed by something other than a letter.
+func parseDrvName(name string) (pkg, version string) {
+	for i := 0; i+1 < len(name); i++ {
+		if name[i] != '-' {
+			continue
+		}
+		ch := name[i+1]
+		if (ch < 'a' || ch > 'z') && (ch < 'A' || ch > 'Z') {
+			return name[:i], name[i+1:]
+		}
+	}
+	return name, ``
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseDrvName(t *testing.T) {
+	tests := []struct {
+		name    string
+		pkg     string
+		version string
+	}{
+		{`openssl-1.1.1k`, `openssl`, `1.1.1k`},
+		{`openssl-1.1.1k-bin`, `openssl`, `1.1.1k-bin`},
+		{`nixos-system-web-21.05.1234`, `nixos-system-web`, `21.05.1234`},
+		{`python3.9-requests-2.25.1`, `python3.9-requests`, `2.25.1`},
+		{`gtk+3-3.24.29`, `gtk+3`, `3.24.29`},
+		{`x86_64-unknown-linux-gnu-binutils-2.35`, `x86_64-unknown-linux-gnu-binutils`, `2.35`},
+		{`unit-script-nginx-start`, `unit-script-nginx-start`, ``},
+		{`hello`, `hello`, ``},
+		{`trailing-`, `trailing-`, ``},
+	}
+	for _, test := range tests {
+		pkg, version := parseDrvName(test.name)
+		if pkg != test.pkg || version != test.version {
+			t.Errorf(`parseDrvName(%q) = %q, %q, expected %q, %q`, test.name, pkg, version, test.pkg, test.version)
+		}
+	}
+}
+
+func TestStorePathName(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{`/nix/store/8hlgx6lcm7hd1wl0bnb2pz6q6vv3bxjn-openssl-1.1.1k-bin`, `openssl-1.1.1k-bin`},
+		{`/nix/store/8hlgx6lcm7hd1wl0bnb2pz6q6vv3bxjn-nixos-system-web-21.05`, `nixos-system-web-21.05`},
+		{`8hlgx6lcm7hd1wl0bnb2pz6q6vv3bxjn-hello`, `hello`},
+		{`/nix/store/nohash`, `nohash`},
+	}
+	for _, test := range tests {
+		got := storePathName(test.path)
+		if got != test.want {
+			t.Errorf(`storePathName(%q) = %q, expected %q`, test.path, got, test.want)
+		}
+	}
+}
+
+func TestByteSizeUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		data string
+		want ByteSize
+		err  bool
+	}{
+		{`1048576`, 1 << 20, false},
+		{`"1048576"`, 1 << 20, false},
+		{`"2GiB"`, 2 << 30, false},
+		{`"1.5 MiB"`, 3 << 19, false},
+		{`0`, 0, false},
+		{`"lots"`, 0, true},
+		{`true`, 0, true},
+	}
+	for _, test := range tests {
+		var got ByteSize
+		err := json.Unmarshal([]byte(test.data), &got)
+		switch {
+		case test.err && err == nil:
+			t.Errorf(`unmarshaling %v succeeded with %v, expected an error`, test.data, got)
+		case !test.err && err != nil:
+			t.Errorf(`unmarshaling %v failed: %v`, test.data, err)
+		case got != test.want:
+			t.Errorf(`unmarshaling %v = %v, expected %v`, test.data, got, test.want)
+		}
+	}
+}
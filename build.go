@@ -6,31 +6,55 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/spf13/cobra"
 )
 
 func init() {
 	rootCmd.AddCommand(buildCmd)
+	buildCmd.Flags().StringVar(
+		&buildTarget, `target`, `system`, `Target to build, such as "system", "amazon", "qcow2", "iso" or "vm"`)
 }
 
 var buildCmd = &cobra.Command{
 	Use:   `build`,
 	Short: `Builds systems for deployment`,
-	Long:  `Build will build NixOS systems locally for deployment.`,
-	RunE:  runBuild,
+	Long: `Build will build NixOS systems locally for deployment.  With --target, it builds another output of the
+system configuration instead, such as a disk image or installer.`,
+	RunE: runBuild,
 }
 
+var buildTarget = `system`
+
 func runBuild(cmd *cobra.Command, args []string) error {
 	ctx := cmd.Context()
 	systems, err := inv.matchSystems(args...)
 	if err != nil {
 		return err
 	}
-	err = inv.build(ctx, systems...)
+	err = inv.buildTarget(ctx, buildTarget, systems...)
 	if err != nil {
 		return err
 	}
+	if buildTarget != `system` && (buildDiff || buildSBOM != ``) {
+		warn(ctx, `--diff and --sbom only describe systems, so they are ignored for the %q target`, buildTarget)
+	}
+	if buildDiff && buildTarget == `system` {
+		err = inv.diff(ctx, systems...)
+		if err != nil {
+			return err
+		}
+		for _, system := range systems {
+			writeClosureDiff(console, system, inv.Systems[system].Diff)
+		}
+	}
+	if buildSBOM != `` && buildTarget == `system` {
+		err = inv.writeSBOMs(ctx, buildSBOM, systems...)
+		if err != nil {
+			return err
+		}
+	}
 	results := make(map[string]string, len(systems))
 	for _, system := range systems {
 		results[system] = inv.Systems[system].Result
@@ -38,38 +62,155 @@ func runBuild(cmd *cobra.Command, args []string) error {
 	return json.NewEncoder(os.Stdout).Encode(inv)
 }
 
-// build builds systems for a specific target, such as "system" for a NixOS system or "vhd" for a disk image.
+// build builds the NixOS system for each of the systems.
 func (inv *Inventory) build(ctx context.Context, systems ...string) error {
+	return inv.buildTarget(ctx, `system`, systems...)
+}
+
+// buildTarget builds systems for a specific target, such as "system" for a NixOS system or "amazon" for a disk image.
+func (inv *Inventory) buildTarget(ctx context.Context, target string, systems ...string) error {
+	if !inv.hasTarget(target) {
+		return fmt.Errorf(`target %q is not one of "system", "%v"`, target, strings.Join(inv.Targets, `", "`))
+	}
+	built := make([]string, 0, len(systems))
 	for _, system := range systems {
-		err := inv.Systems[system].build(ctx, system)
+		fresh, err := inv.Systems[system].build(ctx, system, target)
 		if err != nil {
-			return fmt.Errorf(`%w while building %q`, err, system)
+			return fmt.Errorf(`%w while building %q for %q`, err, target, system)
+		}
+		if fresh {
+			built = append(built, system)
+		}
+	}
+	if buildCheck && target == `system` {
+		err := inv.check(ctx, systems...)
+		if err != nil {
+			return err
+		}
+	}
+	// results are signed once they have passed the check, and only if they were built now; a result reused with
+	// --no build was signed when it was built.
+	for _, system := range built {
+		err := inv.sign(ctx, inv.Systems[system].targetResult(target))
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (cfg *System) build(ctx context.Context, system string) error {
-	if cfg.Result != `` {
-		return nil // already built.
+func (inv *Inventory) hasTarget(target string) bool {
+	if target == `system` {
+		return true
+	}
+	for _, item := range inv.Targets {
+		if item == target {
+			return true
+		}
+	}
+	return false
+}
+
+// build builds a target for a system, unless it has already been built, and reports whether it did.
+func (cfg *System) build(ctx context.Context, system, target string) (built bool, err error) {
+	if result := cfg.targetResult(target); result != `` {
+		if target == `system` {
+			return false, cfg.checkBudget(ctx, system, result) // reused with --no build, but held to the same budget.
+		}
+		return false, nil // already built.
+	}
+	name := system
+	if target != `system` {
+		name = system + `@` + target
+	}
+	ctx, closeLog, err := withLog(ctx, name+`.build`)
+	if err != nil {
+		return false, err
+	}
+	defer closeLog()
+	item := &BuildReport{System: system, Target: target, Log: logPath(ctx)}
+	defer func() {
+		item.Result, item.Error = cfg.targetResult(target), errorText(err)
+		report.addBuild(item)
+	}()
+	inform(ctx, `building %q`, name)
+	// the result is linked from the temp dir until it is known to be within budget, so a build that is not does not
+	// replace the root for the last one.
+	link := filepath.Join(tmp, logName(name))
+	args := []string{`build`, `--out-link`, link, `--argstr`, `target`, target}
+	evalArgs, err := inv.systemArgs(system, `(import <hive/build.nix>)`)
+	if err != nil {
+		return false, err
+	}
+	_, err = execNix(ctx, append(args, evalArgs...)...)
+	if err != nil {
+		return false, err
+	}
+	result, err := os.Readlink(link)
+	if err != nil {
+		return false, err
 	}
-	inform(ctx, `building %q`, system)
-	link := filepath.Join(tmp, `system-`+system)
-	args := []string{`build`, `--out-link`, link, `--include`, `deployment=` + deploymentPath}
+	if target == `system` {
+		err = cfg.checkBudget(ctx, system, result)
+		if err != nil {
+			return false, err
+		}
+	}
+	root, err := rootLink(name)
+	if err != nil {
+		return false, err
+	}
+	_, err = execNix(ctx, `build`, `--out-link`, root, result)
+	if err != nil {
+		return false, fmt.Errorf(`%w while adding a GC root for %q`, err, name)
+	}
+	cfg.setTargetResult(target, result)
+	return true, nil
+}
+
+// systemArgs returns the arguments that evaluate an expression for a named system, such as <hive/build.nix>, with the
+// paths for the system.
+func (inv *Inventory) systemArgs(system, expr string) ([]string, error) {
 	paths := inv.systemPaths(system)
+	args := make([]string, 0, len(paths)*2+8)
 	for _, path := range paths {
 		args = append(args, `--include`, path)
 	}
 	args = append(args, `--argstr`, `name`, system)
-	args = append(args, `(import <hive/build.nix>)`)
-	_, err := execNix(ctx, args...)
+	deployment, err := deploymentArgs(expr)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	result, err := os.Readlink(link)
+	return append(args, deployment...), nil
+}
+
+// sign signs a path and its closure with the signing key, if the deployment has one.
+func (inv *Inventory) sign(ctx context.Context, path string) error {
+	if inv.SigningKey == `` {
+		return nil
+	}
+	_, err := execNix(ctx, `store`, `sign`, `--key-file`, inv.SigningKey, `--recursive`, path)
 	if err != nil {
-		return err
+		return fmt.Errorf(`%w while signing %q`, err, path)
+	}
+	return nil
+}
+
+// targetResult returns the path built for a target, or an empty string if it has not been built.
+func (cfg *System) targetResult(target string) string {
+	if target == `system` {
+		return cfg.Result
+	}
+	return cfg.Targets[target]
+}
+
+func (cfg *System) setTargetResult(target, result string) {
+	if target == `system` {
+		cfg.Result = result
+		return
+	}
+	if cfg.Targets == nil {
+		cfg.Targets = make(map[string]string)
 	}
-	cfg.Result = result
-	return err
+	cfg.Targets[target] = result
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+func init() {
+	buildCmd.Flags().BoolVar(
+		&buildCheck, `check`, false, `Rebuild the top-level derivations of each system and fail if any output differs`)
+}
+
+var buildCheck = false
+
+// nonDeterministicPattern matches the message Nix logs when a rebuilt derivation produces a different output.
+var nonDeterministicPattern = regexp.MustCompile(`derivation '(/nix/store/[^']+\.drv)' may not be deterministic`)
+
+// check rebuilds the derivations behind each system's result, and its direct references, to find derivations that do
+// not build reproducibly.  The derivations are listed in the NonDeterministic field of each system, and check fails
+// if there are any.
+func (inv *Inventory) check(ctx context.Context, systems ...string) error {
+	failed := make([]string, 0, len(systems))
+	for _, system := range systems {
+		cfg := inv.Systems[system]
+		drvs, err := topLevelDerivations(ctx, cfg.Result)
+		if err != nil {
+			return fmt.Errorf(`%w while checking %q`, err, system)
+		}
+		if len(drvs) == 0 {
+			warn(ctx, `the derivations for %q are not in the store, so it cannot be checked`, system)
+			continue
+		}
+		ctx, closeLog, err := withLog(ctx, system+`.check`)
+		if err != nil {
+			return err
+		}
+		inform(ctx, `checking %v derivations for %q`, len(drvs), system)
+		args := []string{`build`, `--rebuild`, `--keep-going`, `--no-link`}
+		for _, drv := range drvs {
+			args = append(args, drv+`^*`)
+		}
+		_, msgs, err := execNixMessages(ctx, args...)
+		closeLog()
+		cfg.NonDeterministic = nil
+		for _, msg := range msgs {
+			for _, match := range nonDeterministicPattern.FindAllStringSubmatch(msg, -1) {
+				cfg.NonDeterministic = append(cfg.NonDeterministic, match[1])
+			}
+		}
+		cfg.NonDeterministic = uniqueStrings(cfg.NonDeterministic)
+		sort.Strings(cfg.NonDeterministic)
+		switch {
+		case len(cfg.NonDeterministic) > 0:
+			for _, drv := range cfg.NonDeterministic {
+				warn(ctx, `%q: %v is not deterministic`, system, drv)
+			}
+			failed = append(failed, system)
+		case err != nil:
+			return fmt.Errorf(`%w while checking %q`, err, system)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf(`%v have non-deterministic derivations`, strings.Join(failed, `, `))
+	}
+	return nil
+}
+
+// topLevelDerivations returns the derivations that produced a path and its direct references, if they are in the
+// store.
+func topLevelDerivations(ctx context.Context, path string) ([]string, error) {
+	data, err := execNix(ctx, `path-info`, `--json`, path)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := parsePathInfo(data)
+	if err != nil || len(infos) == 0 {
+		return nil, err
+	}
+	paths := append([]string{path}, infos[0].References...)
+	data, err = execNix(ctx, append([]string{`path-info`, `--json`}, uniqueStrings(paths)...)...)
+	if err != nil {
+		return nil, err
+	}
+	infos, err = parsePathInfo(data)
+	if err != nil {
+		return nil, err
+	}
+	drvs := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if info.Deriver != `` && pathExists(info.Deriver) {
+			drvs = append(drvs, info.Deriver)
+		}
+	}
+	return uniqueStrings(drvs), nil
+}
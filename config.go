@@ -4,8 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"sort"
 	"strings"
 
@@ -15,19 +17,22 @@ import (
 func init() {
 	rf := rootCmd.PersistentFlags()
 	rf.StringVarP(
-		&deploymentPath, `config`, `c`, `hive.nix`, `Nix deployment configuration path`)
+		&deploymentPath, `config`, `c`, `hive.nix`, `Nix deployment configuration path, or a flake output like ".#hive"`)
 	rf.StringVarP(
 		&statePath, `state`, `s`, `.hive.state`, `Nix-Hive state path`)
+	rf.StringVar(
+		&rootsPath, `roots`, ``, `Directory of Nix GC roots for built systems (default .hive.roots next to the state)`)
 	rf.StringVar(
 		&no, `no`, ``, `List of steps to skip if previously complete, separated by ","`)
 }
 
 // loadInventory evaluates <hive/inventory.nix> to establish inventory.
 func loadInventory(cmd *cobra.Command, args []string) error {
-	data, err := execNix(
-		cmd.Context(), `eval`, `--json`,
-		`--include`, `deployment=`+deploymentPath,
-		`(import <hive/config.nix>)`)
+	args, err := deploymentArgs(`(import <hive/config.nix>)`)
+	if err != nil {
+		return err
+	}
+	data, err := execNix(cmd.Context(), append([]string{`eval`, `--json`}, args...)...)
 	if err != nil {
 		return err
 	}
@@ -66,9 +71,31 @@ func applyState() error {
 			if !ok {
 				return nil // system no longer exists.
 			}
-			if dont.build && pathExists(terms[1]) {
+			if !pathExists(terms[1]) {
+				return nil // collected since the last build.
+			}
+			cfg.Previous = terms[1]
+			if dont.build {
 				cfg.Result = terms[1]
 			}
+		case `t0`: // target result, variant 0.
+			if len(terms) != 3 {
+				return fmt.Errorf(`expected a system, target and result path, for t0, got %v terms`, len(terms))
+			}
+			cfg, ok := inv.Systems[terms[0]]
+			if !ok {
+				return nil // system no longer exists.
+			}
+			if !pathExists(terms[2]) {
+				return nil // collected since the last build.
+			}
+			if cfg.PreviousTargets == nil {
+				cfg.PreviousTargets = make(map[string]string)
+			}
+			cfg.PreviousTargets[terms[1]] = terms[2]
+			if dont.build {
+				cfg.setTargetResult(terms[1], terms[2])
+			}
 		}
 		return nil
 	})
@@ -83,7 +110,11 @@ func pathExists(path string) bool {
 func saveState() error {
 	state := make([]byte, 0, len(inv.Systems)*64)
 	state = appendSystemResultFacts(state)
-	return ioutil.WriteFile(statePath, state, 0600)
+	err := ioutil.WriteFile(statePath, state, 0600)
+	if err != nil {
+		return err
+	}
+	return pruneRoots()
 }
 
 func appendSystemResultFacts(state []byte) []byte {
@@ -93,16 +124,36 @@ func appendSystemResultFacts(state []byte) []byte {
 	}
 	sort.Strings(names)
 	for _, name := range names {
-		result := inv.Systems[name].Result
+		cfg := inv.Systems[name]
+		result := cfg.Result
+		if result == `` {
+			result = cfg.Previous // not built this time, but we should remember the last build.
+		}
 		if result != `` {
 			state = appendFact(state, `r0`, name, result)
 		}
+		results := make(map[string]string, len(cfg.PreviousTargets)+len(cfg.Targets))
+		for target, result := range cfg.PreviousTargets {
+			results[target] = result // not built this time, like Previous.
+		}
+		for target, result := range cfg.Targets {
+			results[target] = result
+		}
+		targets := make([]string, 0, len(results))
+		for target := range results {
+			targets = append(targets, target)
+		}
+		sort.Strings(targets)
+		for _, target := range targets {
+			state = appendFact(state, `t0`, name, target, results[target])
+		}
 	}
 	return state
 }
 
 var deploymentPath = `./hive.nix`
 var statePath = `.hive.state`
+var rootsPath = ``
 var no = ``
 
 var inv Inventory
@@ -121,6 +172,23 @@ type Inventory struct {
 
 	// Instances maps instance information by instance name.
 	Instances map[string]*Instance `json:"instances"`
+
+	// Stores maps named stores by name.  Instances may refer to these stores by name instead of URL.
+	Stores map[string]*Store `json:"stores,omitempty"`
+
+	// Bandwidth limits the bytes per second sent over SSH by all pushes together.  Zero means there is no limit.
+	Bandwidth ByteSize `json:"bandwidth,omitempty"`
+
+	// Copy holds the options for copying paths to every store and instance, unless they override them.
+	Copy *CopyOptions `json:"copy,omitempty"`
+
+	// SigningKey is the path to a Nix secret key file used to sign built systems, so instances and stores that
+	// require signatures will accept them.  This is a path on the build host, and is never copied to the store.
+	SigningKey string `json:"signingKey,omitempty"`
+
+	// Targets lists the names of the targets, other than "system", that may be built for each system, such as
+	// "amazon" or "iso".  See <hive/targets.nix>.
+	Targets []string `json:"targets,omitempty"`
 }
 
 // instanceSystems identifies unique systems associated with instances in the provided patterns, in pattern order.
@@ -153,10 +221,12 @@ func (inv *Inventory) matchSystems(patterns ...string) ([]string, error) {
 func (inv *Inventory) matchInstances(patterns ...string) ([]string, error) {
 	rows := make([][]string, 0, len(inv.Instances))
 	for name, cfg := range inv.Instances {
-		row := make([]string, 2+len(cfg.Tags))
-		row[0] = name
-		row[1] = cfg.System
-		copy(row[2:], cfg.Tags)
+		// patterns may match the name, system or tags, or be qualified as "system:name" or "tag:name".
+		row := make([]string, 0, 3+len(cfg.Tags)*2)
+		row = append(row, name, cfg.System, `system:`+cfg.System)
+		for _, tag := range cfg.Tags {
+			row = append(row, tag, `tag:`+tag)
+		}
 		rows = append(rows, row)
 	}
 	return matchPatterns(patterns, rows...)
@@ -175,21 +245,159 @@ type Instance struct {
 	// System names the system configuration that should be deployed to this instance.
 	System string `json:"system"`
 
-	// Store is the URL to a Nix store where built systems should be uploaded prior to transferring to the
-	// instance.  This is crucial to avoiding redundant transfers of a shared system to multiple instances.
+	// Store is the name of a store in the inventory, or the URL to a Nix store, where built systems should be
+	// uploaded prior to transferring to the instance.  This is crucial to avoiding redundant transfers of a shared
+	// system to multiple instances.
 	Store string `json:"store,omitempty"`
 
 	// Tags provide a way to group instances so they can be targeted for a deployment without using their name.
 	Tags []string `json:"tags,omitempty"`
+
+	// Copy holds options for copying paths to the instance, which override those of the deployment.
+	Copy *CopyOptions `json:"copy,omitempty"`
+}
+
+// A Store describes a Nix store that instances, or other stores, substitute from.
+type Store struct {
+	// URL is the URL of the store, suitable for use with "nix copy --to".
+	URL string `json:"url"`
+
+	// Upstream is the name or URL of the store that this store substitutes from, if any.  Paths are pushed to the
+	// upstream store before this one.
+	Upstream string `json:"upstream,omitempty"`
+
+	// Compression, Region, Endpoint, Profile and Scheme are options for binary cache stores, such as "s3://" stores,
+	// which are added to the URL.  See "nix help-stores" for their meaning.
+	Compression string `json:"compression,omitempty"`
+	Region      string `json:"region,omitempty"`
+	Endpoint    string `json:"endpoint,omitempty"`
+	Profile     string `json:"profile,omitempty"`
+	Scheme      string `json:"scheme,omitempty"`
+
+	// SecretKey is the path to a secret key that a binary cache store uses to sign the paths it receives.
+	SecretKey string `json:"secretKey,omitempty"`
+
+	// Options are additional store options, which are added to the URL.
+	Options map[string]string `json:"options,omitempty"`
+
+	// Bandwidth limits the bytes per second sent over SSH to the store, and to the instances that use it, since they
+	// usually share a link.  Zero means there is no limit.
+	Bandwidth ByteSize `json:"bandwidth,omitempty"`
+
+	// Connections limits how many pushes to the store and the instances that use it may run at once.  Zero means
+	// only --push-jobs limits them.
+	Connections int `json:"connections,omitempty"`
+
+	// Copy holds options for copying paths to the store, which override those of the deployment.
+	Copy *CopyOptions `json:"copy,omitempty"`
+}
+
+// storeURL returns the URL of the store with its options.  Relative "file://" URLs are made absolute, since Nix does
+// not accept them.
+func (cfg *Store) storeURL() string {
+	text := cfg.URL
+	if strings.HasPrefix(text, `file://`) && !strings.HasPrefix(text, `file:///`) {
+		if abs, err := filepath.Abs(strings.TrimPrefix(text, `file://`)); err == nil {
+			text = `file://` + abs
+		}
+	}
+	query := make(url.Values)
+	for name, value := range cfg.Options {
+		query.Set(name, value)
+	}
+	for name, value := range map[string]string{
+		`compression`: cfg.Compression,
+		`region`:      cfg.Region,
+		`endpoint`:    cfg.Endpoint,
+		`profile`:     cfg.Profile,
+		`scheme`:      cfg.Scheme,
+		`secret-key`:  cfg.SecretKey,
+	} {
+		if value != `` {
+			query.Set(name, value)
+		}
+	}
+	if len(query) == 0 {
+		return text
+	}
+	sep := `?`
+	if strings.Contains(text, `?`) {
+		sep = `&`
+	}
+	return text + sep + query.Encode()
+}
+
+// isSSHStore reports whether a store URL uses SSH, and therefore the generated ssh_config.
+func isSSHStore(store string) bool {
+	return strings.HasPrefix(store, `ssh://`) || strings.HasPrefix(store, `ssh-ng://`)
+}
+
+// storeChain returns the URLs of a store and each of its upstream stores, nearest first.  The store may be a name from
+// the inventory or a URL.
+func (inv *Inventory) storeChain(store string) ([]string, error) {
+	var chain []string
+	seen := make(map[string]struct{})
+	for store != `` {
+		if _, dup := seen[store]; dup {
+			return nil, fmt.Errorf(`store %q is its own upstream`, store)
+		}
+		seen[store] = struct{}{}
+		cfg, ok := inv.Stores[store]
+		if !ok {
+			if !isStoreURL(store) {
+				return nil, fmt.Errorf(`store %q is not in the inventory, and is not a store URL`, store)
+			}
+			chain = append(chain, store) // a URL, which has no upstream.
+			break
+		}
+		chain = append(chain, cfg.storeURL())
+		store = cfg.Upstream
+	}
+	return chain, nil
+}
+
+// isStoreURL reports whether a store is given by a URL or path that Nix accepts, rather than a name.
+func isStoreURL(store string) bool {
+	switch store {
+	case `auto`, `daemon`, `local`:
+		return true
+	}
+	return strings.Contains(store, `://`) || strings.HasPrefix(store, `/`)
 }
 
 type System struct {
 	// Paths is a list of Nix paths that should be passed to nix-build when building the system, in --include format.
 	Paths []string `json:"paths,omitempty"`
 
+	// MaxClosureSize is the largest the closure of the built system may be, in bytes.  Zero means there is no limit.
+	MaxClosureSize ByteSize `json:"maxClosureSize,omitempty"`
+
+	// Forbidden lists patterns for package names, or store path names without their hashes, that must not be in the
+	// closure of the built system, such as "gcc" or "*-dev".
+	Forbidden []string `json:"forbidden,omitempty"`
+
 	// Result identifies the path to the built system.  This is populated by the build method, and not by
 	// <hive/inventory.nix>.
 	Result string `json:"result,omitempty"`
+
+	// Targets maps the name of each target built for the system, other than "system", to its path.  Like Result,
+	// this is populated by the build method.
+	Targets map[string]string `json:"targets,omitempty"`
+
+	// NonDeterministic lists derivations behind Result that produced different outputs when rebuilt by
+	// "build --check".
+	NonDeterministic []string `json:"nonDeterministic,omitempty"`
+
+	// Previous identifies the path to the system as it was last built, according to the state.  This is populated by
+	// applyState, and is used to describe what changed in a new build.
+	Previous string `json:"previous,omitempty"`
+
+	// PreviousTargets maps the name of each target, other than "system", to its path as it was last built, according
+	// to the state.  Like Previous, this is populated by applyState.
+	PreviousTargets map[string]string `json:"previousTargets,omitempty"`
+
+	// Diff describes how Result differs from Previous, when requested with "build --diff".
+	Diff *ClosureDiff `json:"diff,omitempty"`
 }
 
 // matchPatterns searches rows for items that match a set of patterns, returning the first item in each row for hit,
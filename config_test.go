@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStoreURL(t *testing.T) {
+	tests := []struct {
+		store Store
+		want  string
+	}{
+		{Store{URL: `ssh://cache`}, `ssh://cache`},
+		{Store{URL: `s3://bucket`, Region: `eu-west-1`, Compression: `zstd`},
+			`s3://bucket?compression=zstd&region=eu-west-1`},
+		{Store{URL: `s3://bucket`, Region: `eu-west-1`, Options: map[string]string{`region`: `us-east-1`}},
+			`s3://bucket?region=eu-west-1`},
+		{Store{URL: `s3://bucket`, Options: map[string]string{`parallel-compression`: `true`}},
+			`s3://bucket?parallel-compression=true`},
+		{Store{URL: `s3://bucket?profile=ops`, SecretKey: `/etc/nix/cache.sec`},
+			`s3://bucket?profile=ops&secret-key=%2Fetc%2Fnix%2Fcache.sec`},
+		{Store{URL: `file:///srv/cache`, Compression: `none`}, `file:///srv/cache?compression=none`},
+	}
+	for _, test := range tests {
+		got := test.store.storeURL()
+		if got != test.want {
+			t.Errorf(`storeURL(%+v) = %q, expected %q`, test.store, got, test.want)
+		}
+	}
+}
+
+func TestStoreChain(t *testing.T) {
+	inv := &Inventory{Stores: map[string]*Store{
+		`central`: {URL: `s3://central`, Region: `eu-west-1`},
+		`east`:    {URL: `ssh://east`, Upstream: `central`},
+		`edge`:    {URL: `ssh://edge`, Upstream: `east`},
+		`direct`:  {URL: `ssh://direct`, Upstream: `ssh://elsewhere`},
+		`loop-a`:  {URL: `ssh://a`, Upstream: `loop-b`},
+		`loop-b`:  {URL: `ssh://b`, Upstream: `loop-a`},
+		`self`:    {URL: `ssh://self`, Upstream: `self`},
+		`typo`:    {URL: `ssh://typo`, Upstream: `centrall`},
+	}}
+	tests := []struct {
+		store string
+		want  []string
+		err   bool
+	}{
+		{``, nil, false},
+		{`central`, []string{`s3://central?region=eu-west-1`}, false},
+		{`edge`, []string{`ssh://edge`, `ssh://east`, `s3://central?region=eu-west-1`}, false},
+		{`direct`, []string{`ssh://direct`, `ssh://elsewhere`}, false},
+		{`ssh://cache`, []string{`ssh://cache`}, false},
+		{`daemon`, []string{`daemon`}, false},
+		{`/srv/store`, []string{`/srv/store`}, false},
+		{`loop-a`, nil, true},
+		{`self`, nil, true},
+		{`typo`, nil, true},
+		{`missing`, nil, true},
+	}
+	for _, test := range tests {
+		got, err := inv.storeChain(test.store)
+		switch {
+		case test.err && err == nil:
+			t.Errorf(`storeChain(%q) = %q, expected an error`, test.store, got)
+		case !test.err && err != nil:
+			t.Errorf(`storeChain(%q) failed: %v`, test.store, err)
+		case !reflect.DeepEqual(got, test.want):
+			t.Errorf(`storeChain(%q) = %q, expected %q`, test.store, got, test.want)
+		}
+	}
+}
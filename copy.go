@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// CopyOptions control how "nix copy" transfers paths to a store or instance.  They may be given for the whole
+// deployment, and for each store and instance, where they override those of the deployment.  Unset options are nil,
+// so they do not override anything.
+type CopyOptions struct {
+	// SubstituteOnDestination lets the destination substitute paths from its own substituters, such as its store,
+	// instead of receiving them.  It defaults to true for SSH stores and instances, and is ignored for binary caches,
+	// which cannot substitute.
+	SubstituteOnDestination *bool `json:"substituteOnDestination,omitempty"`
+
+	// CheckSigs requires the destination to check the signatures of the paths it receives.  It defaults to true.
+	CheckSigs *bool `json:"checkSigs,omitempty"`
+
+	// Compress compresses transfers to SSH stores and instances.  Binary caches use their compression option instead.
+	Compress *bool `json:"compress,omitempty"`
+
+	// Options are Nix options, such as "connect-timeout", passed to "nix copy" with --option.
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// merge returns the options, overridden by those set in more.
+func (opts CopyOptions) merge(more *CopyOptions) CopyOptions {
+	if more == nil {
+		return opts
+	}
+	if more.SubstituteOnDestination != nil {
+		opts.SubstituteOnDestination = more.SubstituteOnDestination
+	}
+	if more.CheckSigs != nil {
+		opts.CheckSigs = more.CheckSigs
+	}
+	if more.Compress != nil {
+		opts.Compress = more.Compress
+	}
+	if len(more.Options) > 0 {
+		merged := make(map[string]string, len(opts.Options)+len(more.Options))
+		for name, value := range opts.Options {
+			merged[name] = value
+		}
+		for name, value := range more.Options {
+			merged[name] = value
+		}
+		opts.Options = merged
+	}
+	return opts
+}
+
+// copyOptions returns the options for copying to a store URL, which is either the URL of a named store, or
+// "ssh://" followed by the name of an instance.
+func (inv *Inventory) copyOptions(store string) CopyOptions {
+	opts := CopyOptions{}.merge(inv.Copy)
+	for _, cfg := range inv.Stores {
+		if cfg.storeURL() == store {
+			opts = opts.merge(cfg.Copy)
+		}
+	}
+	if cfg, ok := inv.Instances[strings.TrimPrefix(store, `ssh://`)]; ok && strings.HasPrefix(store, `ssh://`) {
+		opts = opts.merge(cfg.Copy)
+	}
+	return opts
+}
+
+// copyArgs returns the arguments to "nix copy" that copy paths to a store, with the options for the store.  The
+// NIX_COPYOPTS environment variable may add arguments that override them, split on spaces.
+func (inv *Inventory) copyArgs(store string, paths ...string) []string {
+	opts := inv.copyOptions(store)
+	ssh := isSSHStore(store)
+	if ssh && isTrue(opts.Compress, false) {
+		sep := `?`
+		if strings.Contains(store, `?`) {
+			sep = `&`
+		}
+		store += sep + `compress=true`
+	}
+	args := make([]string, 0, len(paths)+len(opts.Options)*3+8)
+	args = append(args, `copy`, `--to`, store)
+	if ssh && isTrue(opts.SubstituteOnDestination, true) {
+		args = append(args, `--substitute-on-destination`) // binary caches cannot substitute.
+	}
+	if !isTrue(opts.CheckSigs, true) {
+		args = append(args, `--no-check-sigs`)
+	}
+	names := make([]string, 0, len(opts.Options))
+	for name := range opts.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, `--option`, name, opts.Options[name])
+	}
+	args = append(args, strings.Fields(os.Getenv(`NIX_COPYOPTS`))...)
+	return append(args, paths...)
+}
+
+// isTrue returns the value of an optional flag, or def if it is not set.
+func isTrue(flag *bool, def bool) bool {
+	if flag == nil {
+		return def
+	}
+	return *flag
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestCopyArgs(t *testing.T) {
+	yes, no := true, false
+	inv := &Inventory{
+		Copy: &CopyOptions{
+			Compress: &yes,
+			Options:  map[string]string{`connect-timeout`: `5`, `narinfo-cache-negative-ttl`: `0`},
+		},
+		Stores: map[string]*Store{
+			`cache`: {URL: `ssh://cache`, Copy: &CopyOptions{
+				CheckSigs: &no,
+				Options:   map[string]string{`connect-timeout`: `30`},
+			}},
+			`bucket`: {URL: `s3://bucket`, Region: `eu-west-1`},
+		},
+		Instances: map[string]*Instance{
+			`www-1`: {Copy: &CopyOptions{Compress: &no, SubstituteOnDestination: &no}},
+			`www-2`: {},
+		},
+	}
+	const path = `/nix/store/x-path`
+	tests := []struct {
+		store string
+		want  []string
+	}{
+		{`ssh://www-2`, []string{`copy`, `--to`, `ssh://www-2?compress=true`, `--substitute-on-destination`,
+			`--option`, `connect-timeout`, `5`, `--option`, `narinfo-cache-negative-ttl`, `0`, path}},
+		{`ssh://www-1`, []string{`copy`, `--to`, `ssh://www-1`,
+			`--option`, `connect-timeout`, `5`, `--option`, `narinfo-cache-negative-ttl`, `0`, path}},
+		{`ssh://cache`, []string{`copy`, `--to`, `ssh://cache?compress=true`, `--substitute-on-destination`,
+			`--no-check-sigs`, `--option`, `connect-timeout`, `30`, `--option`, `narinfo-cache-negative-ttl`, `0`, path}},
+		{`s3://bucket?region=eu-west-1`, []string{`copy`, `--to`, `s3://bucket?region=eu-west-1`,
+			`--option`, `connect-timeout`, `5`, `--option`, `narinfo-cache-negative-ttl`, `0`, path}},
+	}
+	defer os.Setenv(`NIX_COPYOPTS`, os.Getenv(`NIX_COPYOPTS`))
+	os.Setenv(`NIX_COPYOPTS`, ``)
+	for _, test := range tests {
+		got := inv.copyArgs(test.store, path)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf(`copyArgs(%q) = %q, expected %q`, test.store, got, test.want)
+		}
+	}
+
+	os.Setenv(`NIX_COPYOPTS`, `--option connect-timeout 60`)
+	got := inv.copyArgs(`ssh://www-1`, path)
+	want := []string{`copy`, `--to`, `ssh://www-1`, `--option`, `connect-timeout`, `5`,
+		`--option`, `narinfo-cache-negative-ttl`, `0`, `--option`, `connect-timeout`, `60`, path}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf(`copyArgs with NIX_COPYOPTS = %q, expected %q`, got, want)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -21,8 +22,14 @@ var deployCmd = &cobra.Command{
 	RunE:  runDeploy,
 }
 
-func runDeploy(cmd *cobra.Command, args []string) error {
+func runDeploy(cmd *cobra.Command, args []string) (err error) {
 	ctx := cmd.Context()
+	defer func() {
+		reportErr := saveReport(ctx)
+		if err == nil {
+			err = reportErr
+		}
+	}()
 	instances, err := inv.matchInstances(args...)
 	if err != nil {
 		return err
@@ -32,17 +39,44 @@ func runDeploy(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
-	err = inv.push(ctx, instances, ``)
+	if deployViaAgent {
+		return inv.deployViaAgent(ctx, instances...)
+	}
+	err = generateSshConfig(ctx)
 	if err != nil {
 		return err
 	}
-	err = generateSshConfig(ctx)
+	if !skipPreflight {
+		err = inv.preflight(ctx, instances...)
+		if err != nil {
+			return err
+		}
+	}
+	err = inv.push(ctx, instances, ``)
 	if err != nil {
 		return err
 	}
 	return inv.deploy(ctx, instances...)
 }
 
+// deployViaAgent pushes systems to the stores of each instance, and publishes a manifest that tells the agent on each
+// instance which system to deploy.
+func (inv *Inventory) deployViaAgent(ctx context.Context, instances ...string) error {
+	if deployManifest == `` {
+		return fmt.Errorf(`deploying via agent requires a --manifest`)
+	}
+	for _, instance := range instances {
+		if inv.Instances[instance].Store == `` {
+			warn(ctx, `%q has no store, so its agent must substitute its system from elsewhere`, instance)
+		}
+	}
+	err := inv.pushStores(ctx, instances, ``)
+	if err != nil {
+		return err
+	}
+	return inv.publishManifest(ctx, deployManifest, instances...)
+}
+
 func (inv *Inventory) deploy(ctx context.Context, instances ...string) error {
 	for _, instance := range instances {
 		err := inv.deployInstance(ctx, instance)
@@ -53,18 +87,27 @@ func (inv *Inventory) deploy(ctx context.Context, instances ...string) error {
 	return nil
 }
 
-func (inv *Inventory) deployInstance(ctx context.Context, instance string) error {
+func (inv *Inventory) deployInstance(ctx context.Context, instance string) (err error) {
 	cfg := inv.Instances[instance]
 	path := inv.Systems[cfg.System].Result
-	args := []string{`-F`, filepath.Join(tmp, `ssh_config`), instance, `sudo`, path + `/bin/switch-to-configuration`, `switch`}
-	opts := os.Getenv("NIX_COPYOPTS") //TODO: DOC this and NIX_SSHOPTS
-	if opts != `` {
-		args = append(args, strings.Split(opts, " ")...)
+	ctx, closeLog, err := withLog(ctx, instance+`.deploy`)
+	if err != nil {
+		return err
 	}
-	inform(ctx, `running ssh %v`, strings.Join(args, " "))
-	cmd := exec.CommandContext(ctx, `ssh`, args...)
-	cmd.Env = append(os.Environ(), `NIX_SSHOPTS=-F `+filepath.Join(tmp, `ssh_config`)+` `+os.Getenv(`NIX_SSHOPTS`))
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	return cmd.Run()
+	defer closeLog()
+	item := &InstanceReport{Instance: instance, System: cfg.System, Result: path, Log: logPath(ctx)}
+	defer func() {
+		item.Error = errorText(err)
+		report.addInstance(item)
+	}()
+	args := []string{`-F`, filepath.Join(tmp, `ssh_config`), instance, `sudo`, path + `/bin/switch-to-configuration`, `switch`}
+	// only failures to reach the instance are retried; a failed activation is reported as it is.
+	item.Attempts, err = retry(ctx, `activation on `+instance, func() error {
+		inform(ctx, `running ssh %v`, strings.Join(args, " "))
+		cmd := exec.CommandContext(ctx, `ssh`, args...)
+		cmd.Stderr = logOutput(ctx, console)
+		cmd.Stdout = logOutput(ctx, os.Stdout)
+		return cmd.Run()
+	})
+	return err
 }
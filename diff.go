@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+	diffCmd.Flags().BoolVar(&diffJSON, `json`, false, `Write the differences as JSON instead of text`)
+	buildCmd.Flags().BoolVar(&buildDiff, `diff`, false, `Describe how each system differs from its previous build`)
+}
+
+var diffCmd = &cobra.Command{
+	Use:   `diff [systems]`,
+	Short: `Describes changes between the previous and new build of systems`,
+	Long: `Diff builds systems and compares each new build with the build recorded in the state, listing version
+changes, added or removed packages and the change in closure size.`,
+	RunE: runDiff,
+}
+
+var diffJSON = false
+var buildDiff = false
+
+func runDiff(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	systems, err := inv.matchSystems(args...)
+	if err != nil {
+		return err
+	}
+	err = inv.build(ctx, systems...)
+	if err != nil {
+		return err
+	}
+	err = inv.diff(ctx, systems...)
+	if err != nil {
+		return err
+	}
+	if diffJSON {
+		diffs := make(map[string]*ClosureDiff, len(systems))
+		for _, system := range systems {
+			diffs[system] = inv.Systems[system].Diff
+		}
+		return json.NewEncoder(os.Stdout).Encode(diffs)
+	}
+	for _, system := range systems {
+		writeClosureDiff(os.Stdout, system, inv.Systems[system].Diff)
+	}
+	return nil
+}
+
+// diff compares the result of each system with its previous result, populating the Diff of each system.  Systems
+// without a previous result are left alone.
+func (inv *Inventory) diff(ctx context.Context, systems ...string) error {
+	for _, system := range systems {
+		cfg := inv.Systems[system]
+		if cfg.Previous == `` || cfg.Result == `` {
+			continue
+		}
+		diff, err := diffClosures(ctx, cfg.Previous, cfg.Result)
+		if err != nil {
+			return fmt.Errorf(`%w while comparing builds of %q`, err, system)
+		}
+		cfg.Diff = diff
+	}
+	return nil
+}
+
+// A ClosureDiff describes the difference between two closures, as reported by "nix store diff-closures".
+type ClosureDiff struct {
+	// Before and After are the store paths being compared.
+	Before string `json:"before"`
+	After  string `json:"after"`
+
+	// BeforeSize and AfterSize are the closure sizes of Before and After, in bytes.
+	BeforeSize int64 `json:"beforeSize"`
+	AfterSize  int64 `json:"afterSize"`
+
+	// Changes lists the packages that changed in version or size.
+	Changes []PackageChange `json:"changes,omitempty"`
+}
+
+// A PackageChange describes a change to a package between two closures.  A package that was added has no Before
+// versions, and a package that was removed has no After versions.
+type PackageChange struct {
+	Name      string   `json:"name"`
+	Before    []string `json:"before,omitempty"`
+	After     []string `json:"after,omitempty"`
+	SizeDelta int64    `json:"sizeDelta,omitempty"`
+}
+
+func diffClosures(ctx context.Context, before, after string) (*ClosureDiff, error) {
+	diff := &ClosureDiff{Before: before, After: after}
+	if before == after {
+		return diff, nil
+	}
+	var err error
+	diff.BeforeSize, err = closureSize(ctx, before)
+	if err != nil {
+		return nil, err
+	}
+	diff.AfterSize, err = closureSize(ctx, after)
+	if err != nil {
+		return nil, err
+	}
+	data, err := execNix(ctx, `store`, `diff-closures`, before, after)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == `` {
+			continue
+		}
+		change, err := parsePackageChange(line)
+		if err != nil {
+			return nil, err
+		}
+		diff.Changes = append(diff.Changes, change)
+	}
+	return diff, nil
+}
+
+// parsePackageChange parses a line of "nix store diff-closures" output, which looks like one of:
+//
+//	firefox: 86.0 → 87.0, +1234.5 KiB
+//	libfoo: ∅ → 1.2, +100.0 KiB
+//	zstd: +12.0 KiB
+//
+// Some versions of Nix color the size deltas even when the output is not a terminal, so colors are ignored.
+func parsePackageChange(line string) (PackageChange, error) {
+	var change PackageChange
+	line = stripANSI(line)
+	ix := strings.Index(line, `: `)
+	if ix == -1 {
+		return change, fmt.Errorf(`could not parse closure difference %q`, line)
+	}
+	change.Name, line = line[:ix], line[ix+2:]
+	versions := ``
+	if ix := strings.Index(line, ` → `); ix != -1 {
+		versions, line = line, ``
+		end := strings.LastIndex(versions, `, `)
+		if end > ix && isSizeDelta(versions[end+2:]) {
+			versions, line = versions[:end], versions[end+2:]
+		}
+	}
+	if line != `` {
+		delta, err := parseBytes(strings.TrimPrefix(line, `+`))
+		if err != nil {
+			return change, fmt.Errorf(`%w in closure difference for %q`, err, change.Name)
+		}
+		change.SizeDelta = delta
+	}
+	if versions != `` {
+		parts := strings.SplitN(versions, ` → `, 2)
+		change.Before = parseVersionSet(parts[0])
+		change.After = parseVersionSet(parts[1])
+	}
+	return change, nil
+}
+
+func isSizeDelta(text string) bool {
+	return strings.HasPrefix(text, `+`) || strings.HasPrefix(text, `-`)
+}
+
+// parseVersionSet parses a set of versions from "nix store diff-closures", where "∅" is no versions and "ε" is an
+// empty version.
+func parseVersionSet(text string) []string {
+	if text == `∅` {
+		return nil
+	}
+	versions := strings.Split(text, `, `)
+	for i, version := range versions {
+		if version == `ε` {
+			versions[i] = ``
+		}
+	}
+	return versions
+}
+
+func writeClosureDiff(w io.Writer, system string, diff *ClosureDiff) {
+	if diff == nil {
+		fmt.Fprintf(w, "## %v: no previous build\n", system)
+		return
+	}
+	if diff.Before == diff.After {
+		fmt.Fprintf(w, "## %v: unchanged\n", system)
+		return
+	}
+	fmt.Fprintf(w, "## %v: %v → %v, %v\n",
+		system, formatBytes(diff.BeforeSize), formatBytes(diff.AfterSize), signedBytes(diff.AfterSize-diff.BeforeSize))
+	for _, change := range diff.Changes {
+		fmt.Fprintf(w, "%v:", change.Name)
+		if change.Before != nil || change.After != nil {
+			fmt.Fprintf(w, " %v → %v", formatVersionSet(change.Before), formatVersionSet(change.After))
+			if change.SizeDelta != 0 {
+				fmt.Fprint(w, `,`)
+			}
+		}
+		if change.SizeDelta != 0 {
+			fmt.Fprintf(w, " %v", signedBytes(change.SizeDelta))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func formatVersionSet(versions []string) string {
+	if len(versions) == 0 {
+		return `∅`
+	}
+	text := make([]string, len(versions))
+	for i, version := range versions {
+		if version == `` {
+			version = `ε`
+		}
+		text[i] = version
+	}
+	return strings.Join(text, `, `)
+}
+
+func signedBytes(n int64) string {
+	if n < 0 {
+		return formatBytes(n)
+	}
+	return `+` + formatBytes(n)
+}
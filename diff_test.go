@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePackageChange(t *testing.T) {
+	tests := []struct {
+		line string
+		want PackageChange
+		err  bool
+	}{
+		{`openssl: 1.1.1k → 1.1.1l`,
+			PackageChange{Name: `openssl`, Before: []string{`1.1.1k`}, After: []string{`1.1.1l`}}, false},
+		{`curl: 7.76 → 7.78, +12.5 KiB`,
+			PackageChange{Name: `curl`, Before: []string{`7.76`}, After: []string{`7.78`}, SizeDelta: 12800}, false},
+		{`htop: ∅ → 3.0.5, +250.0 KiB`,
+			PackageChange{Name: `htop`, After: []string{`3.0.5`}, SizeDelta: 256000}, false},
+		{`nano: 5.6.1 → ∅, -2.0 MiB`,
+			PackageChange{Name: `nano`, Before: []string{`5.6.1`}, SizeDelta: -2 << 20}, false},
+		{`etc: ε → ε, +1.5 KiB`,
+			PackageChange{Name: `etc`, Before: []string{``}, After: []string{``}, SizeDelta: 1536}, false},
+		{`glibc: 2.32-46, 2.32-48 → 2.33-47`,
+			PackageChange{Name: `glibc`, Before: []string{`2.32-46`, `2.32-48`}, After: []string{`2.33-47`}}, false},
+		{`systemd: +4.0 KiB`, PackageChange{Name: `systemd`, SizeDelta: 4096}, false},
+		{"curl: 7.76 → 7.78, \033[31;1m+12.5 KiB\033[0m",
+			PackageChange{Name: `curl`, Before: []string{`7.76`}, After: []string{`7.78`}, SizeDelta: 12800}, false},
+		{"zstd: \033[32;1m-1.0 KiB\033[0m", PackageChange{Name: `zstd`, SizeDelta: -1024}, false},
+		{`no separator`, PackageChange{}, true},
+		{`bash: +lots`, PackageChange{}, true},
+	}
+	for _, test := range tests {
+		got, err := parsePackageChange(test.line)
+		switch {
+		case test.err && err == nil:
+			t.Errorf(`parsePackageChange(%q) succeeded, expected an error`, test.line)
+		case !test.err && err != nil:
+			t.Errorf(`parsePackageChange(%q) failed: %v`, test.line, err)
+		case !test.err && !reflect.DeepEqual(got, test.want):
+			t.Errorf(`parsePackageChange(%q) = %#v, expected %#v`, test.line, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// isFlake reports whether the deployment is a flake output, like ".#hive", rather than a hive.nix.
+func isFlake() bool {
+	return strings.Contains(deploymentPath, `#`)
+}
+
+// deploymentArgs returns the arguments that make <deployment> available to a Nix expression, followed by the
+// expression itself.
+//
+// A flake deployment names a hiveConfigurations output, which we expose as <deployment> using a small expression that
+// calls builtins.getFlake.  This keeps <hive/config.nix> and <hive/build.nix> ignorant of flakes, but requires impure
+// evaluation so they can still use the Nix path.  Unless the deployment overrides paths.nixpkgs, it uses the nixpkgs
+// input of the flake, so systems are built from the flake lock instead of the environment.
+func deploymentArgs(expr string) ([]string, error) {
+	if !isFlake() {
+		return []string{`--include`, `deployment=` + deploymentPath, expr}, nil
+	}
+	path := filepath.Join(tmp, `deployment.nix`)
+	err := ioutil.WriteFile(path, []byte(flakeDeployment()), 0600)
+	if err != nil {
+		return nil, err
+	}
+	return []string{`--impure`, `--include`, `deployment=` + path, `--expr`, expr}, nil
+}
+
+func flakeDeployment() string {
+	ix := strings.IndexByte(deploymentPath, '#')
+	ref, name := deploymentPath[:ix], deploymentPath[ix+1:]
+	if name == `` {
+		name = `default`
+	}
+	ref = absoluteFlakeRef(ref)
+	return `let
+  flake = builtins.getFlake ` + quoteNix(ref) + `;
+  hive = flake.hiveConfigurations.${` + quoteNix(name) + `} or (throw ` + quoteNix(`hiveConfigurations.`+name+` not found`) + `);
+  inputs = flake.inputs or { };
+in hive // {
+  paths = (if inputs ? nixpkgs then { inherit (inputs) nixpkgs; } else { }) // (hive.paths or { });
+}
+`
+}
+
+// absoluteFlakeRef makes a flake reference to a local path absolute, since builtins.getFlake does not accept relative
+// paths, and would treat one like "sub/dir" as an indirect reference.  Like nix build, a reference without a URL scheme
+// is a path if it starts with "." or exists.
+func absoluteFlakeRef(ref string) string {
+	path, query := ref, ``
+	if ix := strings.IndexByte(ref, '?'); ix != -1 {
+		path, query = ref[:ix], ref[ix:]
+	}
+	if strings.Contains(path, `:`) {
+		return ref // a URL, like github:owner/repo or git+https://host/repo.
+	}
+	if path == `` {
+		path = `.`
+	}
+	explicit := path == `.` || strings.HasPrefix(path, `./`) || strings.HasPrefix(path, `../`)
+	if !explicit && !pathExists(path) {
+		return ref // an indirect reference, like nixpkgs.
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return ref
+	}
+	return abs + query
+}
+
+// quoteNix quotes a string as a Nix string literal.
+func quoteNix(text string) string {
+	var buf strings.Builder
+	buf.WriteByte('"')
+	for i := 0; i < len(text); i++ {
+		switch ch := text[i]; ch {
+		case '"', '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(ch)
+		case '$':
+			buf.WriteString(`\$`)
+		case '\n':
+			buf.WriteString(`\n`)
+		default:
+			buf.WriteByte(ch)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(gcCmd)
+	addGCFlags(gcCmd)
+}
+
+func addGCFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(
+		&gcLocal, `local`, false, `Drop the local GC roots for the matching systems instead of collecting on instances`)
+	cmd.Flags().IntVar(&gcKeep, `keep`, 5, `Number of recent system generations to keep on each instance`)
+	cmd.Flags().StringVar(
+		&gcOlderThan, `older-than`, ``, `Only delete generations older than this, such as "30d" or "12h"`)
+}
+
+var gcCmd = &cobra.Command{
+	Use:   `gc [patterns]`,
+	Short: `Collects garbage on instances, or drops GC roots for built systems`,
+	Long: `GC deletes old system generations on the instances matching the patterns, keeping the most recent ones
+given by --keep and any newer than --older-than, then runs the Nix garbage collector on the instances and the SSH
+stores they use, in parallel.  The systems Nix-Hive last built for each instance are given GC roots first, so they are
+never collected.
+
+With --local, GC instead removes the GC roots Nix-Hive keeps for the matching systems and forgets their results, so
+the next local "nix-collect-garbage" may delete them.  If no systems are given, the roots for every system are
+dropped.`,
+	RunE: runGC,
+}
+
+var gcLocal = false
+var gcKeep = 5
+var gcOlderThan = ``
+
+// systemProfile is the profile that holds the system generations on an instance.
+const systemProfile = `/nix/var/nix/profiles/system`
+
+// gcRoots is the directory on instances and stores where Nix-Hive keeps GC roots for the systems it built.
+const gcRoots = `/nix/var/nix/gcroots/nix-hive`
+
+func runGC(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	err := checkGCFlags(cmd)
+	if err != nil {
+		return err
+	}
+	if gcLocal {
+		return dropSystemRoots(ctx, args...)
+	}
+	age, err := parseAge(gcOlderThan)
+	if err != nil {
+		return err
+	}
+	instances, err := inv.matchInstances(args...)
+	if err != nil {
+		return err
+	}
+	err = generateSshConfig(ctx)
+	if err != nil {
+		return err
+	}
+	return inv.collectGarbage(ctx, age, instances...)
+}
+
+// checkGCFlags rejects --keep and --older-than with --local, which does not delete generations.
+func checkGCFlags(cmd *cobra.Command) error {
+	if !gcLocal {
+		return nil
+	}
+	for _, name := range []string{`keep`, `older-than`} {
+		if cmd.Flags().Changed(name) {
+			return fmt.Errorf(`--%v only applies when collecting garbage on instances, not with --local`, name)
+		}
+	}
+	return nil
+}
+
+// dropSystemRoots drops the local GC roots for systems, and forgets their results.
+func dropSystemRoots(ctx context.Context, patterns ...string) error {
+	systems, err := inv.matchSystems(patterns...)
+	if err != nil {
+		return err
+	}
+	for _, system := range systems {
+		inform(ctx, `dropping root for %q`, system)
+		err := dropRoot(system)
+		if err != nil {
+			return err
+		}
+		for _, target := range inv.Targets {
+			err := dropRoot(system + `@` + target)
+			if err != nil {
+				return err
+			}
+		}
+		cfg := inv.Systems[system]
+		cfg.Result, cfg.Previous, cfg.Targets, cfg.PreviousTargets = ``, ``, nil, nil
+	}
+	return nil
+}
+
+// A gcHost is an instance or SSH store to collect garbage on.
+type gcHost struct {
+	// name is the instance name, or the store URL.
+	name string
+
+	// target is the destination for ssh.
+	target string
+
+	// port is the port for ssh, if the store URL gives one.
+	port string
+
+	// instance is true for instances, whose system generations are deleted.
+	instance bool
+
+	// roots maps system names to the results that must be kept.
+	roots map[string]string
+
+	deleted int
+	freed   string
+	err     error
+}
+
+// collectGarbage deletes old generations and collects garbage on the instances and their SSH stores, with up to
+// --push-jobs hosts at a time.
+func (inv *Inventory) collectGarbage(ctx context.Context, age time.Duration, instances ...string) error {
+	hosts, err := inv.gcHosts(ctx, instances...)
+	if err != nil {
+		return err
+	}
+	slots := make(chan struct{}, pushJobs)
+	var wg sync.WaitGroup
+	for _, host := range hosts {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(host *gcHost) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			host.err = host.collect(ctx, age)
+		}(host)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, host := range hosts {
+		switch {
+		case host.err != nil:
+			warn(ctx, `%v: %v`, host.name, host.err)
+			failed++
+		case host.instance:
+			inform(ctx, `%v: deleted %v generations, freed %v`, host.name, host.deleted, host.freed)
+		default:
+			inform(ctx, `%v: freed %v`, host.name, host.freed)
+		}
+	}
+	switch failed {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf(`garbage collection failed on one host`)
+	}
+	return fmt.Errorf(`garbage collection failed on %v hosts`, failed)
+}
+
+// gcHosts lists the instances, and the SSH stores in their chains, with the results each must keep.  A store keeps
+// the results for every instance that uses it, not only the matching ones.
+func (inv *Inventory) gcHosts(ctx context.Context, instances ...string) ([]*gcHost, error) {
+	var hosts []*gcHost
+	for _, instance := range instances {
+		host := &gcHost{name: instance, target: instance, instance: true, roots: make(map[string]string)}
+		inv.addGCRoot(ctx, host, inv.Instances[instance].System)
+		hosts = append(hosts, host)
+	}
+
+	stores := make(map[string]*gcHost)
+	for _, instance := range instances {
+		chain, err := inv.storeChain(inv.Instances[instance].Store)
+		if err != nil {
+			return nil, err
+		}
+		for _, store := range chain {
+			target, port := sshTarget(store)
+			if _, dup := stores[store]; dup || target == `` {
+				continue // only SSH stores can be collected.
+			}
+			host := &gcHost{name: store, target: target, port: port, roots: make(map[string]string)}
+			stores[store] = host
+			hosts = append(hosts, host)
+		}
+	}
+	names := make([]string, 0, len(inv.Instances))
+	for name := range inv.Instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, instance := range names {
+		chain, err := inv.storeChain(inv.Instances[instance].Store)
+		if err != nil {
+			return nil, err
+		}
+		for _, store := range chain {
+			if host, ok := stores[store]; ok {
+				inv.addGCRoot(ctx, host, inv.Instances[instance].System)
+			}
+		}
+	}
+	return hosts, nil
+}
+
+func (inv *Inventory) addGCRoot(ctx context.Context, host *gcHost, system string) {
+	result := inv.Systems[system].Result
+	if result == `` {
+		result = inv.Systems[system].Previous // gc does not build, so this is the last build in the state.
+	}
+	if result == `` {
+		warn(ctx, `%q has not been built, so only its generations protect it on %v`, system, host.name)
+		return
+	}
+	host.roots[system] = result
+}
+
+// collect roots the results for the host, deletes old generations on instances, and collects garbage.
+func (host *gcHost) collect(ctx context.Context, age time.Duration) error {
+	ctx, closeLog, err := withLog(ctx, host.name+`.gc`)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	var script strings.Builder
+	fmt.Fprintf(&script, "set -e\nsudo mkdir -p %v\n", gcRoots)
+	systems := make([]string, 0, len(host.roots))
+	for system := range host.roots {
+		systems = append(systems, system)
+	}
+	sort.Strings(systems)
+	for _, system := range systems {
+		// a result that was never pushed to the host does not need a root.
+		fmt.Fprintf(&script, "if [ -e %[1]v ]; then sudo ln -sfn %[1]v %[2]v; fi\n",
+			quoteShell(host.roots[system]), quoteShell(gcRoots+`/`+logName(system)))
+	}
+	if host.instance {
+		// generations are listed in UTC, since the host may not share our time zone.
+		out, err := host.ssh(ctx, `TZ=UTC nix-env --profile `+systemProfile+` --list-generations`)
+		if err != nil {
+			return fmt.Errorf(`%w while listing generations`, err)
+		}
+		deleted := oldGenerations(out, gcKeep, age, time.Now())
+		if len(deleted) > 0 {
+			fmt.Fprintf(&script, "sudo nix-env --profile %v --delete-generations %v\n",
+				systemProfile, strings.Join(deleted, ` `))
+		}
+		host.deleted = len(deleted)
+	}
+	script.WriteString("sudo nix-collect-garbage\n")
+	out, err := host.ssh(ctx, script.String())
+	if err != nil {
+		return err
+	}
+	host.freed = `nothing`
+	if match := gcFreedPattern.FindSubmatch(out); match != nil {
+		host.freed = string(match[1])
+	}
+	return nil
+}
+
+var gcFreedPattern = regexp.MustCompile(`store paths deleted, ([0-9.]+ [KMGT]?i?B) freed`)
+
+// ssh runs a shell command on the host, returning its output, which is also logged.  Stderr is included, since that
+// is where nix-collect-garbage reports the space it freed.
+func (host *gcHost) ssh(ctx context.Context, command string) ([]byte, error) {
+	inform(ctx, `running on %v: %v`, host.name, command)
+	var out bytes.Buffer
+	args := []string{`-F`, filepath.Join(tmp, `ssh_config`)}
+	if host.port != `` {
+		args = append(args, `-p`, host.port)
+	}
+	proc := exec.CommandContext(ctx, `ssh`, append(args, host.target, command)...)
+	proc.Stdout = io.MultiWriter(&out, logOutput(ctx, ioutil.Discard))
+	proc.Stderr = proc.Stdout
+	err := proc.Run()
+	if err != nil {
+		return nil, fmt.Errorf(`%w, see %v`, err, logPath(ctx))
+	}
+	return out.Bytes(), nil
+}
+
+// oldGenerations parses the output of "nix-env --list-generations", with times in UTC, and returns the generations to
+// delete: those that are not current, not among the most recent keep generations, and older than age.
+func oldGenerations(listing []byte, keep int, age time.Duration, now time.Time) []string {
+	type generation struct {
+		id      int
+		time    time.Time
+		current bool
+	}
+	var gens []generation
+	lines := bufio.NewScanner(bytes.NewReader(listing))
+	for lines.Scan() {
+		fields := strings.Fields(lines.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		at, err := time.ParseInLocation(`2006-01-02 15:04:05`, fields[1]+` `+fields[2], time.UTC)
+		if err != nil {
+			continue
+		}
+		gens = append(gens, generation{id, at, len(fields) > 3 && fields[3] == `(current)`})
+	}
+	sort.Slice(gens, func(i, j int) bool { return gens[i].id > gens[j].id })
+	var deleted []string
+	for ix, gen := range gens {
+		if gen.current || ix < keep || now.Sub(gen.time) < age {
+			continue
+		}
+		deleted = append(deleted, strconv.Itoa(gen.id))
+	}
+	return deleted
+}
+
+// parseAge parses an age like "30d", "12h" or "90m", or an empty string, which is no age.
+func parseAge(text string) (time.Duration, error) {
+	if text == `` {
+		return 0, nil
+	}
+	if strings.HasSuffix(text, `d`) {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(text, `d`), 64)
+		if err != nil {
+			return 0, fmt.Errorf(`%q is not an age`, text)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	age, err := time.ParseDuration(text)
+	if err != nil {
+		return 0, fmt.Errorf(`%q is not an age`, text)
+	}
+	return age, nil
+}
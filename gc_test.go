@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func TestOldGenerations(t *testing.T) {
+	listing := []byte(`   1   2021-08-01 10:00:00   
+   2   2021-09-01 10:00:00   
+   3   2021-10-01 10:00:00   
+   4   2021-10-15 10:00:00   (current)
+   5   2021-10-18 10:00:00   
+garbage
+   x   2021-10-18 10:00:00   
+`)
+	now := time.Date(2021, 10, 19, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		keep int
+		age  time.Duration
+		want []string
+	}{
+		{`keep none`, 0, 0, []string{`5`, `3`, `2`, `1`}},
+		{`keep two`, 2, 0, []string{`3`, `2`, `1`}},
+		{`current is kept`, 1, 0, []string{`3`, `2`, `1`}},
+		{`keep all`, 10, 0, nil},
+		{`older than 30 days`, 0, 30 * 24 * time.Hour, []string{`2`, `1`}},
+		{`older than 18 days, in UTC`, 0, 18 * 24 * time.Hour, []string{`3`, `2`, `1`}},
+		{`keep and age`, 4, 30 * 24 * time.Hour, []string{`1`}},
+	}
+	for _, test := range tests {
+		got := oldGenerations(listing, test.keep, test.age, now)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf(`%v: oldGenerations = %v, expected %v`, test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		text string
+		want time.Duration
+		err  bool
+	}{
+		{``, 0, false},
+		{`30d`, 30 * 24 * time.Hour, false},
+		{`1.5d`, 36 * time.Hour, false},
+		{`12h`, 12 * time.Hour, false},
+		{`90m`, 90 * time.Minute, false},
+		{`d`, 0, true},
+		{`30`, 0, true},
+		{`soon`, 0, true},
+	}
+	for _, test := range tests {
+		got, err := parseAge(test.text)
+		switch {
+		case test.err && err == nil:
+			t.Errorf(`parseAge(%q) = %v, expected an error`, test.text, got)
+		case !test.err && err != nil:
+			t.Errorf(`parseAge(%q) failed: %v`, test.text, err)
+		case got != test.want:
+			t.Errorf(`parseAge(%q) = %v, expected %v`, test.text, got, test.want)
+		}
+	}
+}
+
+func TestGCFlags(t *testing.T) {
+	tests := []struct {
+		args  []string
+		local bool
+		keep  int
+		age   string
+		err   bool
+	}{
+		{[]string{`tag:web`, `--keep`, `3`, `--older-than`, `30d`}, false, 3, `30d`, false},
+		{[]string{`www`}, false, 5, ``, false},
+		{[]string{`--local`, `www`}, true, 5, ``, false},
+		{[]string{`--local`, `www`, `--keep`, `3`}, true, 3, ``, true},
+		{[]string{`--local`, `--older-than`, `30d`}, true, 5, `30d`, true},
+	}
+	for _, test := range tests {
+		cmd := &cobra.Command{}
+		addGCFlags(cmd)
+		err := cmd.ParseFlags(test.args)
+		if err != nil {
+			t.Fatalf(`parsing %q failed: %v`, test.args, err)
+		}
+		err = checkGCFlags(cmd)
+		switch {
+		case test.err && err == nil:
+			t.Errorf(`checkGCFlags(%q) succeeded, expected an error`, test.args)
+		case !test.err && err != nil:
+			t.Errorf(`checkGCFlags(%q) failed: %v`, test.args, err)
+		case gcLocal != test.local || gcKeep != test.keep || gcOlderThan != test.age:
+			t.Errorf(`parsing %q gave local %v, keep %v, older-than %q, expected %v, %v, %q`,
+				test.args, gcLocal, gcKeep, gcOlderThan, test.local, test.keep, test.age)
+		}
+	}
+}
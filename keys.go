@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+}
+
+var keysCmd = &cobra.Command{
+	Use:   `keys`,
+	Short: `Writes the public key for the signing key to stdout`,
+	Long: `Keys writes the public key matching the deployment's signingKey, which should be added to the
+"trusted-public-keys" of instances and stores so they accept systems signed by Nix-Hive.`,
+	RunE: runKeys,
+}
+
+func runKeys(cmd *cobra.Command, args []string) error {
+	if inv.SigningKey == `` {
+		return fmt.Errorf(`the deployment does not specify a signingKey`)
+	}
+	key, err := os.Open(inv.SigningKey)
+	if err != nil {
+		return err
+	}
+	defer key.Close()
+	proc := exec.CommandContext(cmd.Context(), `nix`, `key`, `convert-secret-to-public`)
+	proc.Stdin = key
+	proc.Stdout = os.Stdout
+	proc.Stderr = os.Stderr
+	return proc.Run()
+}
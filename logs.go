@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(
+		&logsPath, `logs`, `.hive.logs`, `Directory where build, push and deploy logs are kept`)
+	rootCmd.AddCommand(logsCmd)
+	skipInventory(logsCmd)
+}
+
+var logsCmd = &cobra.Command{
+	Use:   `logs [last|run] [log]`,
+	Short: `Lists and shows logs from previous runs`,
+	Long: `Logs lists the runs with logs, the logs kept for a run, or writes a log to stdout.  Each run keeps its
+logs in a directory named after the time it started and its process, and "last" refers to the most recent run.`,
+	Args: cobra.MaximumNArgs(2),
+	RunE: runLogs,
+}
+
+var logsPath = `.hive.logs`
+
+// runID identifies the logs for this run of Nix-Hive.  The process ID keeps runs that start at the same time apart.
+var runID = fmt.Sprintf(`%v-%v`, time.Now().UTC().Format(`20060102T150405.000Z`), os.Getpid())
+
+func runLogs(cmd *cobra.Command, args []string) error {
+	if len(args) == 0 {
+		runs, err := listLogs(logsPath)
+		if err != nil {
+			return err
+		}
+		for _, run := range runs {
+			fmt.Println(run)
+		}
+		return nil
+	}
+	run := args[0]
+	if run == `last` {
+		runs, err := listLogs(logsPath)
+		if err != nil {
+			return err
+		}
+		if len(runs) == 0 {
+			return fmt.Errorf(`there are no logs in %q`, logsPath)
+		}
+		run = runs[len(runs)-1]
+	}
+	dir := filepath.Join(logsPath, run)
+	if len(args) == 1 {
+		names, err := listLogs(dir)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			fmt.Println(filepath.Join(dir, name))
+		}
+		return nil
+	}
+	name := args[1]
+	if filepath.Ext(name) == `` {
+		name += `.log`
+	}
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(os.Stdout, f)
+	return err
+}
+
+// listLogs lists the entries of a log directory, in order.
+func listLogs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+type logKey struct{}
+
+// A runLog is a log file for a build, push or activation.
+type runLog struct {
+	name string
+	path string
+	sync.Mutex
+	*os.File
+}
+
+func (log *runLog) Write(p []byte) (int, error) {
+	log.Lock()
+	defer log.Unlock()
+	return log.File.Write(p)
+}
+
+// withLog opens a log named name in the logs for this run, and returns a context that will copy output to it.  The
+// returned function closes the log.
+func withLog(ctx context.Context, name string) (context.Context, func() error, error) {
+	dir := filepath.Join(logsPath, runID)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return ctx, nil, err
+	}
+	path := filepath.Join(dir, logName(name)+`.log`)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return context.WithValue(ctx, logKey{}, &runLog{name: name, path: path, File: f}), f.Close, nil
+}
+
+// logName makes a log name, such as a store URL, safe for use as a file name.
+func logName(name string) string {
+	return strings.Map(func(ch rune) rune {
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+			return ch
+		case ch == '.' || ch == '-' || ch == '@':
+			return ch
+		}
+		return '_'
+	}, name)
+}
+
+// logOutput returns a writer that copies output to w and the log for the context, if there is one.
+func logOutput(ctx context.Context, w io.Writer) io.Writer {
+	log, ok := ctx.Value(logKey{}).(*runLog)
+	if !ok {
+		return w
+	}
+	return io.MultiWriter(w, log)
+}
+
+// logPath returns the path to the log for the context, or an empty string if there is no log.
+func logPath(ctx context.Context) string {
+	log, ok := ctx.Value(logKey{}).(*runLog)
+	if !ok {
+		return ``
+	}
+	return log.path
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A Manifest describes the system each instance should be running, for agents that deploy their own systems.  It is
+// published as manifest.json, with a signature in manifest.json.sig if the deployment has a signing key.
+type Manifest struct {
+	// Generated is when the manifest was last published.
+	Generated time.Time `json:"generated"`
+
+	// Instances maps each instance to its desired system.
+	Instances map[string]ManifestEntry `json:"instances"`
+}
+
+// A ManifestEntry describes the system an instance should be running.
+type ManifestEntry struct {
+	System string `json:"system"`
+	Path   string `json:"path"`
+}
+
+// An AgentStatus is reported by an agent after each attempt to deploy its system, as status/<instance>.json next to
+// the manifest.
+type AgentStatus struct {
+	Instance string    `json:"instance"`
+	Path     string    `json:"path"`
+	Current  string    `json:"current"`
+	State    string    `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// publishManifest adds the systems for instances to the manifest at location, which is a directory or an HTTP(S)
+// URL, and signs it with the signing key.
+func (inv *Inventory) publishManifest(ctx context.Context, location string, instances ...string) error {
+	var manifest Manifest
+	data, err := fetchResource(ctx, location, `manifest.json`)
+	switch {
+	case err == nil:
+		err = json.Unmarshal(data, &manifest)
+		if err != nil {
+			return fmt.Errorf(`%w while reading the existing manifest`, err)
+		}
+	case os.IsNotExist(err): // a new manifest.
+	default:
+		return err
+	}
+	if manifest.Instances == nil {
+		manifest.Instances = make(map[string]ManifestEntry, len(instances))
+	}
+	for _, instance := range instances {
+		cfg := inv.Instances[instance]
+		manifest.Instances[instance] = ManifestEntry{System: cfg.System, Path: inv.Systems[cfg.System].Result}
+	}
+	manifest.Generated = time.Now().UTC()
+	data, err = json.MarshalIndent(&manifest, ``, `  `)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	sig := ``
+	if inv.SigningKey != `` {
+		sig, err = signManifest(inv.SigningKey, data)
+		if err != nil {
+			return err
+		}
+	} else {
+		warn(ctx, `the deployment has no signingKey, so the manifest will not be signed`)
+	}
+	// the manifest is stored before its signature, so an agent that reads one with the other's signature in between
+	// rejects it and tries again, rather than trusting a signature written for a manifest that was never published.
+	err = storeResource(ctx, location, `manifest.json`, data)
+	if err != nil {
+		return err
+	}
+	if sig != `` {
+		err = storeResource(ctx, location, `manifest.json.sig`, []byte(sig+"\n"))
+		if err != nil {
+			return err
+		}
+	}
+	inform(ctx, `published a manifest for %v instances to %v`, len(instances), location)
+	return nil
+}
+
+// signManifest signs data with a Nix secret key file, returning a signature in the same "name:base64" form Nix uses.
+func signManifest(keyFile string, data []byte) (string, error) {
+	text, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return ``, err
+	}
+	name, key, err := parseNixKey(string(text), ed25519.PrivateKeySize)
+	if err != nil {
+		return ``, fmt.Errorf(`%w in %v`, err, keyFile)
+	}
+	sig := ed25519.Sign(ed25519.PrivateKey(key), data)
+	return name + `:` + base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// verifyManifest checks that sig is a signature of data by one of the trusted public keys, which are in the form
+// printed by "nix-hive keys".
+func verifyManifest(trusted []string, data []byte, sig string) error {
+	name, sigData, err := parseNixKey(sig, ed25519.SignatureSize)
+	if err != nil {
+		return fmt.Errorf(`%w in the manifest signature`, err)
+	}
+	for _, item := range trusted {
+		keyName, key, err := parseNixKey(item, ed25519.PublicKeySize)
+		if err != nil {
+			return err
+		}
+		if keyName == name && ed25519.Verify(ed25519.PublicKey(key), data, sigData) {
+			return nil
+		}
+	}
+	return fmt.Errorf(`the manifest is not signed by a trusted key`)
+}
+
+// parseNixKey parses a Nix key or signature in the form "name:base64", checking the length of the decoded data.
+func parseNixKey(text string, size int) (string, []byte, error) {
+	text = strings.TrimSpace(text)
+	ix := strings.IndexByte(text, ':')
+	if ix == -1 {
+		return ``, nil, fmt.Errorf(`expected a key name followed by ":"`)
+	}
+	data, err := base64.StdEncoding.DecodeString(text[ix+1:])
+	if err != nil {
+		return ``, nil, err
+	}
+	if len(data) != size {
+		return ``, nil, fmt.Errorf(`expected %v bytes for %q, got %v`, size, text[:ix], len(data))
+	}
+	return text[:ix], data, nil
+}
+
+// fetchResource reads a file from a directory or HTTP(S) URL.  A missing file is reported as an error satisfying
+// os.IsNotExist.
+func fetchResource(ctx context.Context, location, name string) ([]byte, error) {
+	if !isHTTP(location) {
+		return ioutil.ReadFile(filepath.Join(strings.TrimPrefix(location, `file://`), name))
+	}
+	req, err := http.NewRequestWithContext(ctx, `GET`, strings.TrimSuffix(location, `/`)+`/`+name, nil)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	switch {
+	case rsp.StatusCode == http.StatusNotFound:
+		return nil, os.ErrNotExist
+	case rsp.StatusCode/100 != 2:
+		return nil, fmt.Errorf(`%v while fetching %v`, rsp.Status, req.URL)
+	}
+	return ioutil.ReadAll(rsp.Body)
+}
+
+// storeResource writes a file to a directory, or to an HTTP(S) URL using PUT.
+func storeResource(ctx context.Context, location, name string, data []byte) error {
+	if !isHTTP(location) {
+		path := filepath.Join(strings.TrimPrefix(location, `file://`), name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+		// write and rename, so agents never see a partial manifest.
+		err = ioutil.WriteFile(path+`.tmp`, data, 0644)
+		if err != nil {
+			return err
+		}
+		return os.Rename(path+`.tmp`, path)
+	}
+	req, err := http.NewRequestWithContext(
+		ctx, `PUT`, strings.TrimSuffix(location, `/`)+`/`+name, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	io.Copy(ioutil.Discard, rsp.Body)
+	if rsp.StatusCode/100 != 2 {
+		return fmt.Errorf(`%v while storing %v`, rsp.Status, req.URL)
+	}
+	return nil
+}
+
+func isHTTP(location string) bool {
+	return strings.HasPrefix(location, `http://`) || strings.HasPrefix(location, `https://`)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// testKey returns a Nix secret key and its public key, in the forms used by "nix key generate-secret" and
+// "nix-hive keys".
+func testKey(t *testing.T, name string) (secret, public string) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name + `:` + base64.StdEncoding.EncodeToString(priv), name + `:` + base64.StdEncoding.EncodeToString(pub)
+}
+
+func TestVerifyManifest(t *testing.T) {
+	secret, public := testKey(t, `hive-1`)
+	_, other := testKey(t, `hive-1`)
+	_, renamed := testKey(t, `hive-2`)
+	keyFile := filepath.Join(t.TempDir(), `signing-key.sec`)
+	err := ioutil.WriteFile(keyFile, []byte(secret+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(`{"generated":"2021-10-19T12:00:00Z","instances":{}}` + "\n")
+	sig, err := signManifest(keyFile, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		trusted []string
+		data    []byte
+		sig     string
+		ok      bool
+	}{
+		{`signed by a trusted key`, []string{public}, data, sig, true},
+		{`one of several trusted keys`, []string{renamed, public}, data, sig + "\n", true},
+		{`modified manifest`, []string{public}, append([]byte(` `), data...), sig, false},
+		{`wrong key with the same name`, []string{other}, data, sig, false},
+		{`key with another name`, []string{renamed}, data, sig, false},
+		{`no trusted keys`, nil, data, sig, false},
+		{`signature without a name`, []string{public}, data, sig[len(`hive-1:`):], false},
+		{`signature that is not base64`, []string{public}, data, `hive-1:???`, false},
+		{`truncated signature`, []string{public}, data, sig[:len(sig)-8], false},
+		{`malformed trusted key`, []string{`hive-1:AAAA`}, data, sig, false},
+	}
+	for _, test := range tests {
+		err := verifyManifest(test.trusted, test.data, test.sig)
+		if (err == nil) != test.ok {
+			t.Errorf(`%v: verifyManifest returned %v, expected success: %v`, test.name, err, test.ok)
+		}
+	}
+}
+
+func TestParseNixKey(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, ed25519.PublicKeySize))
+	tests := []struct {
+		text string
+		size int
+		name string
+		ok   bool
+	}{
+		{`hive-1:` + key, ed25519.PublicKeySize, `hive-1`, true},
+		{" hive-1:" + key + "\n", ed25519.PublicKeySize, `hive-1`, true},
+		{`cache.example.com-1:` + key, ed25519.PublicKeySize, `cache.example.com-1`, true},
+		{`hive-1:` + key, ed25519.PrivateKeySize, ``, false},
+		{key, ed25519.PublicKeySize, ``, false},
+		{`hive-1:not base64`, ed25519.PublicKeySize, ``, false},
+		{``, ed25519.PublicKeySize, ``, false},
+	}
+	for _, test := range tests {
+		name, data, err := parseNixKey(test.text, test.size)
+		switch {
+		case (err == nil) != test.ok:
+			t.Errorf(`parseNixKey(%q, %v) returned %v, expected success: %v`, test.text, test.size, err, test.ok)
+		case test.ok && (name != test.name || len(data) != test.size):
+			t.Errorf(`parseNixKey(%q, %v) = %q and %v bytes`, test.text, test.size, name, len(data))
+		}
+	}
+}
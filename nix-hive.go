@@ -10,6 +10,11 @@ import (
 )
 
 func main() {
+	os.Exit(run())
+}
+
+// run runs the command, and returns the status for main to exit with once the temp dir has been removed.
+func run() int {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
@@ -27,8 +32,17 @@ func main() {
 
 	err = rootCmd.ExecuteContext(ctx)
 	if err != nil {
-		os.Exit(1)
+		if stateLoaded {
+			// cobra skips postRun when a command fails, but anything built before the failure has replaced its GC
+			// root, so the state must still record it.
+			err := saveState()
+			if err != nil {
+				warn(ctx, `could not save the state: %v`, err)
+			}
+		}
+		return 1
 	}
+	return exitCode
 }
 
 var rootCmd = &cobra.Command{
@@ -49,6 +63,7 @@ func preRun(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	stateLoaded = true
 	return nil
 }
 
@@ -60,12 +75,26 @@ func postRun(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// skipInventory keeps a command from loading the inventory and saving the state, for commands that do not need a
+// deployment.
+func skipInventory(cmd *cobra.Command) {
+	cmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error { return nil }
+	cmd.PersistentPostRunE = func(cmd *cobra.Command, args []string) error { return nil }
+}
+
 var tmp = ``
 
+// stateLoaded is set once preRun has applied the state, so it is saved even if the command fails.
+var stateLoaded = false
+
+// exitCode is the status to exit with when a command succeeds, for commands like throttle that pass on the status of
+// another program.
+var exitCode = 0
+
 func inform(ctx context.Context, msg string, info ...interface{}) {
-	fmt.Fprintf(os.Stderr, ".. "+msg+"\n", info...)
+	fmt.Fprintf(logOutput(ctx, console), ".. "+msg+"\n", info...)
 }
 
 func warn(ctx context.Context, msg string, info ...interface{}) {
-	fmt.Fprintf(os.Stderr, ":: "+msg+"\n", info...)
+	fmt.Fprintf(logOutput(ctx, console), ":: "+msg+"\n", info...)
 }
@@ -2,18 +2,91 @@ package main
 
 import (
 	"context"
-	"os"
+	"encoding/json"
+	"fmt"
 	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
 )
 
+// execNix runs a Nix command, returning its output.  Nix reports its progress using "--log-format internal-json",
+// which is summarized on the console and logged for the context.
 func execNix(ctx context.Context, args ...string) ([]byte, error) {
+	data, _, err := execNixMessages(ctx, args...)
+	return data, err
+}
+
+// execNixMessages runs a Nix command like execNix, and also returns the messages Nix logged, such as errors.
+func execNixMessages(ctx context.Context, args ...string) ([]byte, []string, error) {
 	inform(ctx, `running nix %v`, strings.Join(args, " "))
-	cmd := exec.CommandContext(ctx, `nix`, args...)
-	cmd.Stderr = os.Stderr
+	cmd := exec.CommandContext(ctx, `nix`, nixLogArgs(args)...)
+	progress := newProgress(ctx, `nix `+args[0])
+	cmd.Stderr = progress
 	data, err := cmd.Output()
+	progress.Close()
+	if err != nil {
+		return nil, progress.messages, err
+	}
+	return data, progress.messages, nil
+}
+
+// nixLogArgs prefixes the arguments to a Nix command with the options that make it report progress as JSON.
+func nixLogArgs(args []string) []string {
+	return append([]string{`--log-format`, `internal-json`}, args...)
+}
+
+// closureSize returns the size of the closure of a store path, as reported by "nix path-info -S".
+func closureSize(ctx context.Context, path string) (int64, error) {
+	data, err := execNix(ctx, `path-info`, `-S`, path)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf(`could not parse closure size of %q from %q`, path, data)
+	}
+	return strconv.ParseInt(fields[len(fields)-1], 10, 64)
+}
+
+// PathInfo describes a valid store path, as reported by "nix path-info --json".
+type PathInfo struct {
+	Path       string   `json:"path"`
+	NarHash    string   `json:"narHash,omitempty"`
+	NarSize    int64    `json:"narSize"`
+	Deriver    string   `json:"deriver,omitempty"`
+	References []string `json:"references,omitempty"`
+}
+
+// closureInfo describes each path in the closure of a store path.
+func closureInfo(ctx context.Context, path string) ([]PathInfo, error) {
+	data, err := execNix(ctx, `path-info`, `--recursive`, `--json`, path)
 	if err != nil {
 		return nil, err
 	}
-	return data, nil
+	return parsePathInfo(data)
+}
+
+// parsePathInfo parses the output of "nix path-info --json", which is a list of objects in older versions of Nix, and
+// an object keyed by path in newer ones.
+func parsePathInfo(data []byte) ([]PathInfo, error) {
+	var list []PathInfo
+	if json.Unmarshal(data, &list) == nil {
+		return list, nil
+	}
+	var keyed map[string]*PathInfo
+	err := json.Unmarshal(data, &keyed)
+	if err != nil {
+		return nil, err
+	}
+	list = make([]PathInfo, 0, len(keyed))
+	for path, info := range keyed {
+		if info == nil {
+			continue // not valid.
+		}
+		info.Path = path
+		list = append(list, *info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list, nil
 }
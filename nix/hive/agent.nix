@@ -0,0 +1,86 @@
+# <hive/agent.nix> is a NixOS module that runs "nix-hive agent", which deploys the system for the instance from a
+# manifest published by "nix-hive deploy --via-agent" instead of waiting for Nix-Hive to connect over SSH.  The
+# instance must be able to substitute its system from one of its substituters, which is usually its store.
+{ config, lib, pkgs, ... }:
+let
+  inherit (lib) concatMapStringsSep escapeShellArg mkEnableOption mkIf mkOption optionalString types;
+  cfg = config.services.nix-hive-agent;
+in {
+  options.services.nix-hive-agent = {
+    enable = mkEnableOption "the Nix-Hive deployment agent";
+
+    package = mkOption {
+      type = types.package;
+      default = pkgs.hive;
+      defaultText = "pkgs.hive";
+      description = "The Nix-Hive package, from the overlay in nix/overlay.nix.";
+    };
+
+    manifest = mkOption {
+      type = types.str;
+      example = "https://hive.example.com/manifest";
+      description = "The directory or HTTP(S) URL where the manifest is published.";
+    };
+
+    instance = mkOption {
+      type = types.str;
+      default = config.networking.hostName;
+      description = "The name of this instance in the manifest.";
+    };
+
+    trustedKeys = mkOption {
+      type = types.listOf types.str;
+      default = [ ];
+      description = ''Public keys trusted to sign the manifest, as printed by "nix-hive keys".'';
+    };
+
+    insecure = mkOption {
+      type = types.bool;
+      default = false;
+      description = "Accept an unsigned manifest, which lets anyone who can publish one choose the system.";
+    };
+
+    status = mkOption {
+      type = types.nullOr types.str;
+      default = null;
+      description = "The directory or HTTP(S) URL where status is reported; the manifest location by default.";
+    };
+
+    interval = mkOption {
+      type = types.str;
+      default = "1m";
+      description = "The time between polls of the manifest.";
+    };
+  };
+
+  config = mkIf cfg.enable {
+    assertions = [{
+      assertion = cfg.trustedKeys != [ ] || cfg.insecure;
+      message = "services.nix-hive-agent needs trustedKeys, or insecure to accept an unsigned manifest.";
+    }];
+
+    systemd.services.nix-hive-agent = {
+      description = "Nix-Hive deployment agent";
+      wantedBy = [ "multi-user.target" ];
+      after = [ "network-online.target" ];
+      wants = [ "network-online.target" ];
+      path = [ config.nix.package ];
+
+      # The agent activates new systems itself, so activation must not restart it.
+      restartIfChanged = false;
+
+      serviceConfig.Restart = "always";
+      serviceConfig.RestartSec = "30s";
+      serviceConfig.StateDirectory = "nix-hive-agent";
+      script = ''
+        exec ${cfg.package}/bin/nix-hive agent \
+          --manifest ${escapeShellArg cfg.manifest} \
+          --instance ${escapeShellArg cfg.instance} \
+          --interval ${escapeShellArg cfg.interval} \
+          ${optionalString (cfg.status != null) "--status ${escapeShellArg cfg.status}"} \
+          ${optionalString cfg.insecure "--insecure"} \
+          ${concatMapStringsSep " " (key: "--trusted-key ${escapeShellArg key}") cfg.trustedKeys}
+      '';
+    };
+  };
+}
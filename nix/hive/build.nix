@@ -1,19 +1,28 @@
 # <hive/build.nix> builds a named system from the systems section of <deployment> and returns the resulting path.
 # This is invoked by Nix-Hive using the paths from <hive/config.nix> like:
-#  nix build -I nixpkgs=... -I deployment=... --argstr "name" ... nix/system.nix
-{ name }:
+#  nix build -I nixpkgs=... -I deployment=... --argstr "name" ... --argstr "target" ... nix/system.nix
+#
+# The target is "system" for the NixOS system itself, or one of the targets from <hive/targets.nix> or the targets
+# section of <deployment>, such as "amazon" or "iso".
+{ name, target ? "system" }:
 let
+  inherit (builtins) hasAttr;
   deployment = import <deployment>;
-  systems = deployment.systems or (throw "systems not specified in deployment");
-  system = systems.${name} or (throw "system ${name} could not be found");
-  nixos = import <nixpkgs/nixos>;
-  result = nixos {
-    configuration = if !builtins.hasAttr "configuration" system then
-      throw "missing system configuration"
-    else if !builtins.isFunction system.configuration then
-      throw "system configuration should be a function"
-    else
-      system.configuration;
-    system = system.system or builtins.currentSystem;
+  targets = (import ./targets.nix) // (deployment.targets or { });
+  spec = if target == "system" then {
+    modules = [ ];
+    attribute = "toplevel";
+  } else
+    targets.${target} or (throw "target ${target} could not be found");
+  result = import ./eval.nix {
+    inherit name;
+    modules = spec.modules or [ ];
   };
-in result.system
+  build = result.config.system.build;
+in if hasAttr "attributes" spec then
+  result.pkgs.linkFarm "${name}-${target}" (map (attr: {
+    name = attr;
+    path = build.${attr};
+  }) spec.attributes)
+else
+  build.${spec.attribute}
@@ -1,14 +1,16 @@
 # # See doc/internals.md for an explanation of what this expression does.
 let
-  inherit (builtins) attrNames concatStringsSep getAttr hasAttr isString mapAttrs;
+  inherit (builtins) attrNames concatStringsSep elemAt filter getAttr hasAttr isPath isString mapAttrs match toString;
   deployment = import <deployment>;
 
   # Explode converts a attrset of name=value pairs into a list of attrsets, each consisting of one pair.
   explode = attrs: map (name: "${name}=${getAttr name attrs}") (attrNames attrs);
   explodePaths = attrs: explode (attrs.paths or { });
 
-  enumerateSystem = name: system: { 
-    paths = explodePaths system; 
+  enumerateSystem = name: system: {
+    paths = explodePaths system;
+    maxClosureSize = system.maxClosureSize or 0;
+    forbidden = system.forbidden or [ ];
   };
 
   # We enumerate all of the systems and their paths.  This serves two functions -- we know which systems need to be
@@ -24,17 +26,64 @@ let
     else
       throw "system ${system} not found in the systems section";
 
-  # checkStore checks that a store is a string.
+  # checkKey checks that a secret key is named by a string, since a Nix path would copy the secret key into the store,
+  # where any process could read it.
+  checkKey = what: key:
+    if isPath key then
+      throw "${what} must be a string, not a path, so the key is not copied to the Nix store"
+    else if !isString key then
+      throw "${what} must be a string naming a secret key file"
+    else
+      key;
+
+  # checkStore checks that a store is a string, which either names a store from the stores section or is a URL.
   checkStore = store:
     if !isString store then
-      throw ''instance stores must be specified by a URL suitable for use with "nix copy --to"''
+      throw ''stores must be named, or specified by a URL suitable for use with "nix copy --to"''
+    else if store == "" || hasAttr store (deployment.stores or { }) || match ".*://.*" store != null then
+      store
     else
-      store;
+      throw "store ${store} is not in the stores section, and is not a URL";
+
+  # Copy options control how "nix copy" transfers paths, for the deployment, and for each store and instance, which
+  # override the deployment's.  Options that are not given are null, so they do not override anything.
+  optionString = value: if value == true then "true" else if value == false then "false" else toString value;
+  enumerateCopy = copy: {
+    substituteOnDestination = copy.substituteOnDestination or null;
+    checkSigs = copy.checkSigs or null;
+    compress = copy.compress or null;
+    options = mapAttrs (name: optionString) (copy.options or { });
+  };
+
+  # Stores may be named in the stores section, with a URL and an optional upstream store that the store substitutes
+  # from.  Nix-Hive fills a chain of stores from the most upstream store outward.
+  #
+  # Binary cache stores, such as "s3://", "file://" and "http://" stores, may also specify options that are added to
+  # their URL.  A secretKey must be named by a string, like signingKey, so it is not copied to the Nix store.
+  #
+  # Bandwidth and connections limit the pushes to a store and to the instances that use it, which usually share a link.
+  enumerateStore = name: store: {
+    url = if isString (store.url or null) then store.url else throw "store ${name} does not specify a URL";
+    upstream = checkStore (store.upstream or "");
+    compression = store.compression or "";
+    region = store.region or "";
+    endpoint = store.endpoint or "";
+    profile = store.profile or "";
+    scheme = store.scheme or "";
+    secretKey = checkKey "stores.${name}.secretKey" (store.secretKey or "");
+    options = mapAttrs (name: toString) (store.options or { });
+    bandwidth = store.bandwidth or 0;
+    connections = store.connections or 0;
+    copy = enumerateCopy (store.copy or { });
+  };
+
+  stores = mapAttrs enumerateStore (deployment.stores or { });
 
   enumerateInstance = name: instance: {
     tags = instance.tags or [ ];
     store = checkStore (instance.store or "");
     system = checkSystem (instance.system or (throw "instance ${name} does not specify a system."));
+    copy = enumerateCopy (instance.copy or { });
   };
 
   instances = mapAttrs enumerateInstance (deployment.instances or { });
@@ -43,17 +92,34 @@ let
   # the systems.
   paths = (explodePaths deployment);
 
-  sshHostConfig = name:
-    let
-      config = deployment.instances.${name}.ssh or { };
-      options = map (name: "  ${name} ${getAttr name config}") (attrNames config);
+  # SSH options may be given for each instance, for each SSH store, and for the deployment, which applies to every host.
+  # Since ssh uses the first value it finds for an option, the deployment's options come last.
+  sshHostConfig = host: config:
+    let options = map (name: "  ${name} ${optionString (getAttr name config)}") (attrNames config);
     in if options == [ ] then
       ""
     else ''
-      Host ${name}
+      Host ${host}
       ${concatStringsSep "\n" options}
     '';
 
-  instanceNames = attrNames instances;
-  ssh = concatStringsSep "" (map sshHostConfig instanceNames);
-in { inherit instances paths ssh systems; }
+  # storeHost returns the host name from an SSH store URL, or null for other stores.
+  storeHost = url:
+    let parts = match "ssh(-ng)?://([^@/]*@)?([^/?:]*).*" url;
+    in if parts == null then null else elemAt parts 2;
+
+  instanceSSH = map (name: sshHostConfig name (deployment.instances.${name}.ssh or { })) (attrNames instances);
+  storeSSH = map (name: sshHostConfig (storeHost stores.${name}.url) (deployment.stores.${name}.ssh or { }))
+    (filter (name: storeHost stores.${name}.url != null) (attrNames stores));
+  ssh = concatStringsSep "" (instanceSSH ++ storeSSH ++ [ (sshHostConfig "*" (deployment.ssh or { })) ]);
+
+  signingKey = checkKey "signingKey" (deployment.signingKey or "");
+
+  # Bandwidth limits pushes over SSH, in bytes per second, or a string like "10M".  Stores may have their own limits.
+  bandwidth = deployment.bandwidth or 0;
+
+  copy = enumerateCopy (deployment.copy or { });
+
+  # We emit the names of the targets that <hive/build.nix> can build, in addition to "system".
+  targets = attrNames ((import ./targets.nix) // (deployment.targets or { }));
+in { inherit bandwidth copy instances paths signingKey ssh stores systems targets; }
@@ -0,0 +1,13 @@
+# <hive/disk-image.nix> adds config.system.build.diskImage, a bootable disk image in the given format, to a system.
+format:
+{ config, lib, pkgs, modulesPath, ... }: {
+  fileSystems."/" = lib.mkDefault {
+    device = "/dev/disk/by-label/nixos";
+    fsType = "ext4";
+    autoResize = true;
+  };
+  boot.loader.grub.device = lib.mkDefault "/dev/vda";
+  system.build.diskImage = import "${toString modulesPath}/../lib/make-disk-image.nix" {
+    inherit config lib pkgs format;
+  };
+}
@@ -0,0 +1,20 @@
+# <hive/eval.nix> evaluates a named system from the systems section of <deployment> with <nixpkgs/nixos>, adding any
+# extra modules, and returns the result without building anything.  This is shared by <hive/build.nix> and
+# <hive/licenses.nix>.
+{ name, modules ? [ ] }:
+let
+  inherit (builtins) hasAttr isFunction;
+  deployment = import <deployment>;
+  systems = deployment.systems or (throw "systems not specified in deployment");
+  system = systems.${name} or (throw "system ${name} could not be found");
+  nixos = import <nixpkgs/nixos>;
+in nixos {
+  configuration = if !hasAttr "configuration" system then
+    throw "missing system configuration"
+  else if !isFunction system.configuration then
+    throw "system configuration should be a function"
+  else {
+    imports = [ system.configuration ] ++ modules;
+  };
+  system = system.system or builtins.currentSystem;
+}
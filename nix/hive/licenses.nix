@@ -0,0 +1,30 @@
+# <hive/licenses.nix> maps the output paths of the packages installed by a named system to the licenses named in
+# their metadata, for use in a software bill of materials.  Store paths do not remember the metadata of the
+# derivations that produced them, so this is only available for packages the configuration names directly.
+#
+# Each license has the SPDX identifier Nixpkgs gives it, as "id", if it has one, and a short and full name.
+{ name }:
+let
+  inherit (builtins) concatMap filter isAttrs isList listToAttrs map toString unsafeDiscardStringContext;
+  result = import ./eval.nix { inherit name; };
+  packages = filter (pkg: pkg ? outPath) result.config.environment.systemPackages;
+  licenseInfo = license:
+    if isAttrs license then
+      {
+        name = license.shortName or license.fullName or "unknown";
+        fullName = license.fullName or license.shortName or "unknown";
+      } // (if license ? spdxId then { id = license.spdxId; } else { })
+      // (if license ? url then { url = license.url; } else { })
+    else {
+      name = toString license;
+      fullName = toString license;
+    };
+  licenses = pkg:
+    let license = pkg.meta.license or [ ];
+    in map licenseInfo (if isList license then license else [ license ]);
+  outputs = pkg: map (output: pkg.${output}) (pkg.outputs or [ "out" ]);
+in listToAttrs (concatMap (pkg:
+  map (output: {
+    name = unsafeDiscardStringContext output.outPath;
+    value = licenses pkg;
+  }) (outputs pkg)) packages)
@@ -0,0 +1,12 @@
+# <hive/package.nix> imports a Nix file that evaluates to a derivation, or to a function that returns one, such as:
+#
+#   { pkgs ? import <nixpkgs> { } }: pkgs.writeShellApplication { name = "fix"; text = "..."; }
+#
+# Functions are called with pkgs, if they take it, from <nixpkgs>.  This is invoked by Nix-Hive like:
+#  nix build -I nixpkgs=... --argstr path /path/to/fix.nix '(import <hive/package.nix>)'
+{ path }:
+let
+  inherit (builtins) functionArgs intersectAttrs isFunction;
+  value = import path;
+  args = intersectAttrs (functionArgs value) { pkgs = import <nixpkgs> { }; };
+in if isFunction value then value args else value
@@ -0,0 +1,40 @@
+# <hive/shell.nix> builds the environment of a shell made with mkShell, such as:
+#
+#   { pkgs ? import <nixpkgs> { } }: pkgs.mkShell { buildInputs = [ pkgs.htop pkgs.tcpdump ]; }
+#
+# so commands can run in it on instances that do not have Nix-Hive, or nix-shell's idea of the expression.  This is
+# invoked by Nix-Hive like:
+#  nix build -I nixpkgs=... --argstr path /path/to/tools.nix '(import <hive/shell.nix>)'
+#
+# mkShell produces a derivation that is not meant to be built; nix-shell sources $stdenv/setup with its environment
+# instead, then runs the shellHook.  We replace its phases with one that does the same inside the build, and captures
+# the resulting environment in $out/rc, with $out/bin/hive-shell to run a command with it.  The paths in the
+# environment, such as PATH, make the inputs of the shell part of the closure of the result.
+{ path }:
+let shell = import ./package.nix { inherit path; };
+in shell.overrideAttrs (_: {
+  phases = [ "buildPhase" ];
+  buildPhase = ''
+    mkdir -p $out/bin
+    while IFS= read -r -d "" entry; do
+      case ''${entry%%=*} in
+        # variables that only make sense inside the build.
+        HOME|PWD|OLDPWD|SHLVL|TERM|TZ|PATH|SHELL|out|outputs|builder|phases|buildPhase|shellHook) ;;
+        TMP|TMPDIR|TEMP|TEMPDIR|NIX_BUILD_TOP|NIX_BUILD_CORES|NIX_LOG_FD|NIX_STORE|SSL_CERT_FILE) ;;
+        NIX_ENFORCE_PURITY|IN_NIX_SHELL|stdenv|system|name|passAsFile|_|__*) ;;
+        *) printf 'export %s=%q\n' "''${entry%%=*}" "''${entry#*=}" ;;
+      esac
+    done < <(env -0) > $out/rc
+    printf 'export PATH=%q"''${PATH:+:$PATH}"\n' "$PATH" >> $out/rc
+    printf '%s\n' "$shellHook" >> $out/rc
+
+    cat > $out/bin/hive-shell <<EOF
+    #!$BASH
+    # Runs a command in the environment of a shell built by Nix-Hive, or an interactive shell if there is no command.
+    source $out/rc
+    if [ \$# -eq 0 ]; then exec $BASH; fi
+    exec "\$@"
+    EOF
+    chmod +x $out/bin/hive-shell
+  '';
+})
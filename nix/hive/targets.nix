@@ -0,0 +1,34 @@
+# <hive/targets.nix> describes the default build targets offered by <hive/build.nix>, in addition to "system".  Each
+# target lists NixOS modules that are added to the system configuration, and the attribute (or attributes) of
+# config.system.build that should be built.  Deployments may add or replace targets with their own "targets" section.
+{
+  amazon = {
+    modules = [ <nixpkgs/nixos/maintainers/scripts/ec2/amazon-image.nix> ];
+    attribute = "amazonImage";
+  };
+
+  qcow2 = {
+    modules = [ (import ./disk-image.nix "qcow2") ];
+    attribute = "diskImage";
+  };
+
+  raw = {
+    modules = [ (import ./disk-image.nix "raw") ];
+    attribute = "diskImage";
+  };
+
+  iso = {
+    modules = [ <nixpkgs/nixos/modules/installer/cd-dvd/installation-cd-minimal.nix> ];
+    attribute = "isoImage";
+  };
+
+  netboot = {
+    modules = [ <nixpkgs/nixos/modules/installer/netboot/netboot-minimal.nix> ];
+    attributes = [ "kernel" "netbootRamdisk" "netbootIpxeScript" ];
+  };
+
+  vm = {
+    modules = [ <nixpkgs/nixos/modules/virtualisation/qemu-vm.nix> ];
+    attribute = "vm";
+  };
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(preflightCmd)
+	deployCmd.Flags().BoolVar(
+		&skipPreflight, `skip-preflight`, false, `Deploy without checking that instances and stores are ready`)
+}
+
+var preflightCmd = &cobra.Command{
+	Use:   `preflight [patterns]`,
+	Short: `Checks that instances and their stores are ready for a deployment`,
+	Long: `Preflight connects to each instance, and each SSH store the instance uses, and checks that it can be
+reached through the generated ssh_config, that sudo does not need a password, that Nix is installed, that the local
+user is trusted to import unsigned paths if they are not signed, that each instance and store substitutes from its
+store, and that there is space in /nix for the closure of the system.  Problems are grouped by cause.  Deploy runs
+these checks before pushing anything, unless it is given --skip-preflight.`,
+	RunE: runPreflight,
+}
+
+var skipPreflight = false
+
+func runPreflight(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	instances, err := inv.matchInstances(args...)
+	if err != nil {
+		return err
+	}
+	err = generateSshConfig(ctx)
+	if err != nil {
+		return err
+	}
+	return inv.preflight(ctx, instances...)
+}
+
+// Causes of preflight failures, which are used to group them.
+const (
+	cannotConnect     = `cannot connect over SSH`
+	sudoNeedsPassword = `sudo requires a password`
+	nixMissing        = `Nix is not installed`
+	untrusted         = `not trusted to import unsigned paths`
+	missingSubstitute = `does not substitute from its store`
+	insufficientSpace = `not enough free space in /nix`
+	storeUnreachable  = `store cannot be reached`
+)
+
+// A preflightCheck describes a store or instance to check, and what it must be ready for.
+type preflightCheck struct {
+	// name identifies the instance, or the URL of the store.
+	name string
+
+	// target is the destination for ssh, or empty for a binary cache.
+	target string
+
+	// port is the port for ssh, if the store URL gives one.
+	port string
+
+	// sudo is true if deployment runs commands with sudo, which is true for instances.
+	sudo bool
+
+	// substituter is the URL of the store that should be one of the substituters, if any.
+	substituter string
+
+	// size is the closure size of the largest system that will be pushed, or zero if it is not known.
+	size int64
+
+	// unsized lists the systems that will be pushed whose closure size is not known, since they have not been built.
+	unsized []string
+
+	failures map[string]string
+}
+
+func (check *preflightCheck) fail(cause, msg string, info ...interface{}) {
+	check.failures[cause] = fmt.Sprintf(msg, info...)
+}
+
+// preflight checks that the instances, and the SSH stores they use, are ready for a deployment.
+func (inv *Inventory) preflight(ctx context.Context, instances ...string) error {
+	ctx, closeLog, err := withLog(ctx, `preflight`)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	checks, err := inv.preflightChecks(ctx, instances...)
+	if err != nil {
+		return err
+	}
+
+	slots := make(chan struct{}, pushJobs+1)
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(check *preflightCheck) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			inv.runPreflightCheck(ctx, check)
+		}(check)
+	}
+	wg.Wait()
+
+	causes := make(map[string][]string)
+	failed := 0
+	for _, check := range checks {
+		if len(check.failures) > 0 {
+			failed++
+		}
+		for cause, detail := range check.failures {
+			causes[cause] = append(causes[cause], check.name+`: `+detail)
+		}
+	}
+	if failed == 0 {
+		inform(ctx, `%v instances and stores are ready`, len(checks))
+		return nil
+	}
+	order := make([]string, 0, len(causes))
+	for cause := range causes {
+		order = append(order, cause)
+	}
+	sort.Strings(order)
+	for _, cause := range order {
+		sort.Strings(causes[cause])
+		warn(ctx, `%v (%v):`, cause, len(causes[cause]))
+		for _, item := range causes[cause] {
+			warn(ctx, `  %v`, item)
+		}
+	}
+	return fmt.Errorf(`preflight checks failed for %v of %v instances and stores`, failed, len(checks))
+}
+
+// preflightChecks lists the checks for each instance and the stores in its chain, each store appearing once.
+func (inv *Inventory) preflightChecks(ctx context.Context, instances ...string) ([]*preflightCheck, error) {
+	sizes := make(map[string]int64)
+	var checks []*preflightCheck
+	stores := make(map[string]*preflightCheck)
+	for _, instance := range instances {
+		cfg := inv.Instances[instance]
+		size, ok := sizes[cfg.System]
+		if !ok {
+			// a standalone preflight has not built anything, so the last build is the best guess at the size.
+			result := inv.Systems[cfg.System].Result
+			if result == `` {
+				result = inv.Systems[cfg.System].Previous
+			}
+			if result != `` {
+				var err error
+				size, err = closureSize(ctx, result)
+				if err != nil {
+					return nil, err
+				}
+			}
+			sizes[cfg.System] = size
+		}
+		chain, err := inv.storeChain(cfg.Store)
+		if err != nil {
+			return nil, err
+		}
+		check := &preflightCheck{name: instance, target: instance, sudo: true, size: size}
+		if size == 0 {
+			check.unsized = []string{cfg.System}
+		}
+		if len(chain) > 0 {
+			check.substituter = chain[0]
+		}
+		checks = append(checks, check)
+		for ix, store := range chain {
+			check, ok := stores[store]
+			if !ok {
+				target, port := sshTarget(store)
+				check = &preflightCheck{name: store, target: target, port: port}
+				if ix+1 < len(chain) {
+					check.substituter = chain[ix+1]
+				}
+				stores[store] = check
+				checks = append(checks, check)
+			}
+			if size > check.size {
+				check.size = size
+			}
+			if size == 0 {
+				check.unsized = append(check.unsized, cfg.System)
+			}
+		}
+	}
+	for _, check := range checks {
+		check.failures = make(map[string]string)
+		check.unsized = uniqueStrings(check.unsized)
+	}
+	return checks, nil
+}
+
+// preflightScript reports what preflight needs to know about a host, as name=value lines.
+const preflightScript = `echo nix=$(nix --version 2>/dev/null)
+if sudo -n true 2>/dev/null; then echo sudo=yes; else echo sudo=no; fi
+echo substituters=$( (nix --extra-experimental-features nix-command show-config || nix show-config) 2>/dev/null |
+  sed -n 's/^\(extra-\)\{0,1\}substituters = //p' | tr '\n' ' ')
+echo free=$(df -Pk /nix | awk 'NR==2 { print $4 }')`
+
+func (inv *Inventory) runPreflightCheck(ctx context.Context, check *preflightCheck) {
+	if check.target == `` {
+		// a binary cache, which only has to be reachable.
+		_, err := execNix(ctx, `store`, `ping`, `--store`, check.name)
+		if err != nil {
+			check.fail(storeUnreachable, `%v`, err)
+		}
+		return
+	}
+
+	inform(ctx, `checking %v`, check.name)
+	var stdout, stderr bytes.Buffer
+	args := []string{`-F`, filepath.Join(tmp, `ssh_config`)}
+	if check.port != `` {
+		args = append(args, `-p`, check.port)
+	}
+	proc := exec.CommandContext(ctx, `ssh`, append(args, check.target, preflightScript)...)
+	proc.Stdout = &stdout
+	proc.Stderr = &stderr
+	err := proc.Run()
+	if err != nil {
+		check.fail(cannotConnect, `%v: %v`, err, strings.TrimSpace(stderr.String()))
+		return
+	}
+	facts := make(map[string]string)
+	lines := bufio.NewScanner(&stdout)
+	for lines.Scan() {
+		ix := strings.IndexByte(lines.Text(), '=')
+		if ix > 0 {
+			facts[lines.Text()[:ix]] = strings.TrimSpace(lines.Text()[ix+1:])
+		}
+	}
+
+	if facts[`nix`] == `` {
+		check.fail(nixMissing, `"nix --version" failed`)
+	} else {
+		inform(ctx, `%v has %v`, check.name, facts[`nix`])
+	}
+	if check.sudo && facts[`sudo`] != `yes` {
+		check.fail(sudoNeedsPassword, `"sudo -n true" failed`)
+	}
+	if check.substituter != `` && !hasSubstituter(strings.Fields(facts[`substituters`]), check.substituter) {
+		check.fail(missingSubstitute, `%v is not one of its substituters`, check.substituter)
+	}
+	free, err := strconv.ParseInt(facts[`free`], 10, 64)
+	switch {
+	case err != nil:
+		check.fail(insufficientSpace, `could not read the free space from df`)
+	case check.size > 0 && free*1024 < check.size:
+		check.fail(insufficientSpace, `%v free, but the closure is %v`,
+			formatBytes(free*1024), formatBytes(check.size))
+	case len(check.unsized) > 0 && check.size == 0:
+		warn(ctx, `skipped checking the free space in /nix on %v, since %v has not been built`,
+			check.name, strings.Join(check.unsized, `, `))
+	case len(check.unsized) > 0:
+		warn(ctx, `checked the free space in /nix on %v without %v, which has not been built`,
+			check.name, strings.Join(check.unsized, `, `))
+	}
+	inv.checkTrust(ctx, check)
+}
+
+// checkTrust checks that the local user is a trusted user of a host, if the paths pushed to it are not signed, or it
+// does not check signatures.
+func (inv *Inventory) checkTrust(ctx context.Context, check *preflightCheck) {
+	store := check.name
+	if check.sudo {
+		store = `ssh://` + check.name
+	}
+	if inv.SigningKey != `` && isTrue(inv.copyOptions(store).CheckSigs, true) {
+		return // signed paths do not need a trusted user.
+	}
+	cmd := exec.CommandContext(ctx, `nix`, `store`, `ping`, `--json`, `--store`, sshNGStore(check.target, check.port))
+	cmd.Env = nixSSHEnv()
+	data, err := cmd.Output()
+	var info struct {
+		Trusted *int `json:"trusted"`
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &info)
+	}
+	switch {
+	case err != nil || info.Trusted == nil:
+		inform(ctx, `could not tell whether %v trusts this user, since its Nix does not say`, check.name)
+	case *info.Trusted == 0:
+		check.fail(untrusted, `this user is not in trusted-users, and the paths are not signed`)
+	}
+}
+
+// hasSubstituter reports whether a store is one of the substituters, comparing their hosts and paths, since an
+// instance may reach its store with a different scheme, such as "https://" instead of "ssh://".
+func hasSubstituter(substituters []string, store string) bool {
+	want, err := url.Parse(store)
+	if err != nil {
+		return false
+	}
+	for _, item := range substituters {
+		have, err := url.Parse(item)
+		if err != nil || have.Hostname() != want.Hostname() {
+			continue
+		}
+		if strings.TrimSuffix(have.Path, `/`) == strings.TrimSuffix(want.Path, `/`) {
+			return true
+		}
+	}
+	return false
+}
+
+// sshTarget returns the destination for ssh from an SSH store URL, such as "user@host", and its port, if it has one.
+// The destination is empty if the store does not use SSH.
+func sshTarget(store string) (string, string) {
+	if !isSSHStore(store) {
+		return ``, ``
+	}
+	u, err := url.Parse(store)
+	if err != nil {
+		return ``, ``
+	}
+	if u.User != nil {
+		return u.User.Username() + `@` + u.Hostname(), u.Port()
+	}
+	return u.Hostname(), u.Port()
+}
+
+// sshNGStore returns the URL of the ssh-ng store for an ssh destination and port, which may be empty.
+func sshNGStore(target, port string) string {
+	if port == `` {
+		return `ssh-ng://` + target
+	}
+	user, host := ``, target
+	if ix := strings.LastIndexByte(target, '@'); ix != -1 {
+		user, host = target[:ix+1], target[ix+1:]
+	}
+	return `ssh-ng://` + user + net.JoinHostPort(host, port)
+}
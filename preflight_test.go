@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestSSHTarget(t *testing.T) {
+	tests := []struct {
+		store  string
+		target string
+		port   string
+	}{
+		{`ssh://cache`, `cache`, ``},
+		{`ssh://nix@cache`, `nix@cache`, ``},
+		{`ssh://user@cache:2222`, `user@cache`, `2222`},
+		{`ssh-ng://cache:2222?compress=true`, `cache`, `2222`},
+		{`ssh://[fe80::1]:2222`, `fe80::1`, `2222`},
+		{`s3://bucket?region=eu-west-1`, ``, ``},
+		{`https://cache.example.com`, ``, ``},
+	}
+	for _, test := range tests {
+		target, port := sshTarget(test.store)
+		if target != test.target || port != test.port {
+			t.Errorf(`sshTarget(%q) = %q, %q, expected %q, %q`, test.store, target, port, test.target, test.port)
+		}
+	}
+}
+
+func TestSSHNGStore(t *testing.T) {
+	tests := []struct {
+		target string
+		port   string
+		want   string
+	}{
+		{`cache`, ``, `ssh-ng://cache`},
+		{`user@cache`, ``, `ssh-ng://user@cache`},
+		{`user@cache`, `2222`, `ssh-ng://user@cache:2222`},
+		{`fe80::1`, `2222`, `ssh-ng://[fe80::1]:2222`},
+	}
+	for _, test := range tests {
+		got := sshNGStore(test.target, test.port)
+		if got != test.want {
+			t.Errorf(`sshNGStore(%q, %q) = %q, expected %q`, test.target, test.port, got, test.want)
+		}
+	}
+}
+
+func TestHasSubstituter(t *testing.T) {
+	tests := []struct {
+		substituters []string
+		store        string
+		want         bool
+	}{
+		{[]string{`https://cache.nixos.org/`, `ssh://cache`}, `ssh://cache`, true},
+		{[]string{`https://cache/`}, `ssh://cache`, true},
+		{[]string{`ssh://cache:2222`}, `ssh://user@cache`, true},
+		{[]string{`https://cache/nix`}, `https://cache`, false},
+		{[]string{`https://cache.nixos.org/`}, `ssh://cache`, false},
+		{nil, `ssh://cache`, false},
+	}
+	for _, test := range tests {
+		got := hasSubstituter(test.substituters, test.store)
+		if got != test.want {
+			t.Errorf(`hasSubstituter(%q, %q) = %v, expected %v`, test.substituters, test.store, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Nix activity and result types, from nix/src/libutil/logging.hh.
+const (
+	actCopyPath   = 100
+	actCopyPaths  = 103
+	actBuilds     = 104
+	actBuild      = 105
+	actSubstitute = 108
+
+	resBuildLogLine = 101
+	resProgress     = 105
+)
+
+// logTailLines is the number of lines of each build log kept to explain a failure.
+const logTailLines = 25
+
+// console writes messages to stderr, beneath a status line describing the progress of each running Nix command when
+// stderr is a terminal.
+var console = newConsole(os.Stderr)
+
+type terminal struct {
+	out    io.Writer
+	tty    bool
+	lock   sync.Mutex
+	shown  bool
+	order  []string
+	status map[string]string
+}
+
+func newConsole(f *os.File) *terminal {
+	return &terminal{out: f, tty: isTerminal(f), status: make(map[string]string)}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Write writes p above the status line.
+func (t *terminal) Write(p []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.clear()
+	n, err := t.out.Write(p)
+	if bytes.HasSuffix(p, []byte{'\n'}) {
+		t.draw()
+	}
+	return n, err
+}
+
+// setStatus sets the status for a label, or removes it if the status is empty.
+func (t *terminal) setStatus(label, status string) {
+	if !t.tty {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, present := t.status[label]
+	switch {
+	case status == `` && present:
+		delete(t.status, label)
+		for i, item := range t.order {
+			if item == label {
+				t.order = append(t.order[:i], t.order[i+1:]...)
+				break
+			}
+		}
+	case status == ``:
+		return
+	case !present:
+		t.order = append(t.order, label)
+		fallthrough
+	default:
+		t.status[label] = status
+	}
+	t.clear()
+	t.draw()
+}
+
+func (t *terminal) clear() {
+	if t.shown {
+		io.WriteString(t.out, "\r\033[K")
+		t.shown = false
+	}
+}
+
+func (t *terminal) draw() {
+	if len(t.order) == 0 {
+		return
+	}
+	items := make([]string, 0, len(t.order))
+	for _, label := range t.order {
+		items = append(items, label+`: `+t.status[label])
+	}
+	io.WriteString(t.out, `[`+strings.Join(items, `] [`)+`]`)
+	t.shown = true
+}
+
+// A progress interprets the "--log-format internal-json" output of a Nix command, writing a readable form of it to
+// the log for its context, and summarizing it on the console.
+type progress struct {
+	ctx     context.Context
+	label   string
+	log     io.Writer
+	partial []byte
+	drawn   time.Time
+
+	activities map[int64]*activity
+	builds     counter
+	copies     counter
+	bytes      map[int64]counter
+	failures   []string
+	messages   []string
+
+	// rate is the bytes copied per second, measured over at least rateWindow.
+	rate     float64
+	rateAt   time.Time
+	rateDone int64
+}
+
+// rateWindow is the shortest time over which the transfer rate is measured.
+const rateWindow = 2 * time.Second
+
+// An activity is something Nix has started, such as a build or copy.
+type activity struct {
+	kind int
+	text string
+	path string
+	tail []string
+}
+
+// A counter tracks the progress of an activity, as reported by Nix.
+type counter struct {
+	done, expected, running, failed int64
+}
+
+// newProgress returns a progress for a Nix command, labelled with the name of the log for the context, or the
+// command itself.
+func newProgress(ctx context.Context, command string) *progress {
+	log, ok := ctx.Value(logKey{}).(*runLog)
+	p := &progress{
+		ctx:        ctx,
+		label:      command,
+		log:        ioutil.Discard,
+		activities: make(map[int64]*activity),
+		bytes:      make(map[int64]counter),
+	}
+	if ok {
+		p.label, p.log = log.name, log
+	}
+	return p
+}
+
+// logEvent is an event from "nix --log-format internal-json", as documented in nix/src/libutil/logging.cc.
+type logEvent struct {
+	Action string            `json:"action"`
+	ID     int64             `json:"id"`
+	Parent int64             `json:"parent"`
+	Level  int               `json:"level"`
+	Type   int               `json:"type"`
+	Text   string            `json:"text"`
+	Msg    string            `json:"msg"`
+	Fields []json.RawMessage `json:"fields"`
+}
+
+func (p *progress) Write(data []byte) (int, error) {
+	n := len(data)
+	p.partial = append(p.partial, data...)
+	for {
+		ix := bytes.IndexByte(p.partial, '\n')
+		if ix == -1 {
+			break
+		}
+		p.handleLine(p.partial[:ix])
+		p.partial = p.partial[ix+1:]
+	}
+	if time.Since(p.drawn) > 100*time.Millisecond {
+		p.drawn = time.Now()
+		console.setStatus(p.label, p.status())
+	}
+	return n, nil
+}
+
+// Close flushes any incomplete line, removes the status line, and explains any failures.
+func (p *progress) Close() error {
+	if len(p.partial) > 0 {
+		p.handleLine(p.partial)
+		p.partial = nil
+	}
+	console.setStatus(p.label, ``)
+	for _, drv := range p.failures {
+		for _, act := range p.activities {
+			if act.kind != actBuild || act.path != drv || len(act.tail) == 0 {
+				continue
+			}
+			fmt.Fprintf(console, "!! last %v lines of the log for %v:\n", len(act.tail), drv)
+			for _, line := range act.tail {
+				fmt.Fprintf(console, "!!   %v\n", line)
+			}
+		}
+	}
+	return nil
+}
+
+var drvPattern = regexp.MustCompile(`/nix/store/[0-9a-z]{32}-[^'"\s]+\.drv`)
+
+func (p *progress) handleLine(line []byte) {
+	if !bytes.HasPrefix(line, []byte(`@nix `)) {
+		p.print(string(line)) // not from Nix, perhaps from ssh.
+		return
+	}
+	var ev logEvent
+	if json.Unmarshal(line[5:], &ev) != nil {
+		p.print(string(line))
+		return
+	}
+	switch ev.Action {
+	case `msg`:
+		msg := stripANSI(ev.Msg)
+		p.messages = append(p.messages, msg)
+		p.print(msg)
+		if ev.Level == 0 {
+			p.failures = append(p.failures, drvPattern.FindAllString(ev.Msg, -1)...)
+		}
+	case `start`:
+		act := &activity{kind: ev.Type, text: ev.Text}
+		if len(ev.Fields) > 0 {
+			json.Unmarshal(ev.Fields[0], &act.path)
+		}
+		p.activities[ev.ID] = act
+		switch ev.Type {
+		case actBuild, actCopyPath, actSubstitute:
+			if ev.Text != `` {
+				p.logLine(stripANSI(ev.Text))
+				if !console.tty {
+					p.print(stripANSI(ev.Text))
+				}
+			}
+		}
+	case `result`:
+		act := p.activities[ev.ID]
+		switch ev.Type {
+		case resBuildLogLine:
+			var text string
+			if len(ev.Fields) > 0 {
+				json.Unmarshal(ev.Fields[0], &text)
+			}
+			p.logLine(text)
+			if act != nil {
+				act.tail = append(act.tail, text)
+				if len(act.tail) > logTailLines {
+					act.tail = act.tail[1:]
+				}
+			}
+		case resProgress:
+			if act == nil {
+				return
+			}
+			c := parseCounter(ev.Fields)
+			switch act.kind {
+			case actBuilds:
+				p.builds = c
+			case actCopyPaths:
+				p.copies = c
+			case actCopyPath:
+				p.bytes[ev.ID] = c
+			}
+		}
+	}
+}
+
+func parseCounter(fields []json.RawMessage) counter {
+	var n [4]int64
+	for i := 0; i < len(fields) && i < len(n); i++ {
+		json.Unmarshal(fields[i], &n[i])
+	}
+	return counter{n[0], n[1], n[2], n[3]}
+}
+
+// print writes a line to the log and the console.
+func (p *progress) print(line string) {
+	fmt.Fprintln(logOutput(p.ctx, console), line)
+}
+
+// logLine writes a line to the log only.
+func (p *progress) logLine(line string) {
+	fmt.Fprintln(p.log, line)
+}
+
+// status summarizes the progress of the command.
+func (p *progress) status() string {
+	items := make([]string, 0, 3)
+	if p.builds.expected > 0 {
+		item := fmt.Sprintf(`built %v/%v`, p.builds.done, p.builds.expected)
+		if p.builds.running > 0 {
+			item += fmt.Sprintf(` (%v running)`, p.builds.running)
+		}
+		if p.builds.failed > 0 {
+			item += fmt.Sprintf(` (%v failed)`, p.builds.failed)
+		}
+		items = append(items, item)
+	}
+	if p.copies.expected > 0 {
+		items = append(items, fmt.Sprintf(`copied %v/%v paths`, p.copies.done, p.copies.expected))
+	}
+	if len(p.bytes) > 0 {
+		var done, expected int64
+		for _, c := range p.bytes {
+			done += c.done
+			expected += c.expected
+		}
+		item := fmt.Sprintf(`%v/%v`, formatBytes(done), formatBytes(expected))
+		switch elapsed := time.Since(p.rateAt); {
+		case p.rateAt.IsZero():
+			p.rateAt, p.rateDone = time.Now(), done
+		case elapsed >= rateWindow:
+			p.rate = float64(done-p.rateDone) / elapsed.Seconds()
+			p.rateAt, p.rateDone = time.Now(), done
+		}
+		if p.rate > 0 {
+			item += fmt.Sprintf(` at %v/s`, formatBytes(int64(p.rate)))
+		}
+		items = append(items, item)
+	}
+	if len(items) == 0 {
+		return `working`
+	}
+	return strings.Join(items, `, `)
+}
+
+var ansiPattern = regexp.MustCompile("\033\\[[0-9;]*[a-zA-Z]")
+
+func stripANSI(text string) string {
+	return ansiPattern.ReplaceAllString(text, ``)
+}
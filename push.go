@@ -15,6 +15,10 @@ import (
 
 func init() {
 	rootCmd.AddCommand(pushCmd)
+	rootCmd.PersistentFlags().IntVar(
+		&pushJobs, `push-jobs`, 4, `Number of stores and instances that may receive paths at the same time`)
+	rootCmd.PersistentFlags().BoolVar(
+		&pushVerify, `verify`, false, `Copy paths to every store and instance, even those that appear to have them`)
 }
 
 var pushCmd = &cobra.Command{
@@ -24,6 +28,9 @@ var pushCmd = &cobra.Command{
 	RunE:  runPush,
 }
 
+var pushJobs = 4
+var pushVerify = false
+
 func runPush(cmd *cobra.Command, args []string) error {
 	ctx := cmd.Context()
 	instances, err := inv.matchInstances(args...)
@@ -38,46 +45,46 @@ func runPush(cmd *cobra.Command, args []string) error {
 	//TODO: let users specify a path to push.
 	err = inv.push(ctx, instances, ``)
 	if err != nil {
+		saveReport(ctx)
 		return err
 	}
-	return nil
+	return saveReport(ctx)
 }
 
 // push pushes a path to each instance, caching the paths in the instance stores as necessary.  If a path is an empty
 // string, the system path for the instance will be used.
+//
+// Each store or instance that receives paths is a job in a graph, where an instance depends on its store.  Jobs are
+// run in parallel, up to pushJobs at a time, and an instance's copy starts as soon as its store has the paths.  Stores
+// with upstream stores depend on them in turn, so chains of stores are filled from the most upstream store outward,
+// and a store shared by several chains receives the paths once.
 func (inv *Inventory) push(ctx context.Context, instances []string, paths ...string) error {
+	return inv.pushTo(ctx, true, instances, paths...)
+}
+
+// pushStores pushes paths to the stores of each instance like push, but not to the instances themselves.
+func (inv *Inventory) pushStores(ctx context.Context, instances []string, paths ...string) error {
+	return inv.pushTo(ctx, false, instances, paths...)
+}
+
+func (inv *Inventory) pushTo(ctx context.Context, toInstances bool, instances []string, paths ...string) error {
 	err := generateSshConfig(ctx)
 	if err != nil {
 		return err
 	}
 
-	type push struct {
-		Path  string
-		Store string
-	}
-	pushes := make([]push, 0, len(instances)*2)
-	added := make(map[push]struct{}, cap(pushes))
-	stores := make([]string, 0, cap(pushes))
-	jobs := make(map[string][]string, cap(stores))
-
-	addPush := func(path, store string) {
-		item := push{path, store}
-		if _, dup := added[item]; dup {
-			return
-		}
-		added[item] = struct{}{}
-		pushes = append(pushes, item)
-		job, ok := jobs[store]
-		if !ok {
-			job = make([]string, 0, len(instances))
-			stores = append(stores, store)
-		}
-		job = append(job, path)
-		jobs[store] = job
-	}
-
+	limits := inv.transferLimits(ctx)
+	graph := newPushGraph()
 	for _, instance := range instances {
 		cfg := inv.Instances[instance]
+		chain, err := inv.storeChain(cfg.Store)
+		if err != nil {
+			return err
+		}
+		var limit *transferLimit // instances share the limits of their store.
+		if len(chain) > 0 {
+			limit = limits[chain[0]]
+		}
 		for _, path := range paths {
 			if path == `` {
 				path = inv.Systems[cfg.System].Result
@@ -85,38 +92,236 @@ func (inv *Inventory) push(ctx context.Context, instances []string, paths ...str
 			if path == `` {
 				continue // no system, no path, nothing to do.
 			}
-			if cfg.Store != `` {
-				addPush(path, cfg.Store)
+			var job *pushJob
+			if toInstances {
+				job = graph.add(`ssh://`+instance, path)
+				job.limit = limit
 			}
-			addPush(path, `ssh://`+instance)
+			for _, store := range chain {
+				dep := graph.add(store, path)
+				dep.limit = limits[store]
+				if job != nil {
+					job.after(dep)
+				}
+				job = dep
+			}
+		}
+	}
+	err = graph.check()
+	if err != nil {
+		return err
+	}
+	if !pushVerify {
+		graph.query(ctx, pushJobs, hasNixPaths)
+	}
+	stop, err := inv.startThrottle(ctx, limits)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	return graph.run(ctx, pushJobs, inv.pushNixPaths)
+}
+
+// A pushGraph describes the stores and instances that must receive paths, and the order they must receive them.
+type pushGraph struct {
+	order []string
+	jobs  map[string]*pushJob
+}
+
+// A pushJob copies paths to a store or instance, after the jobs it depends on have finished.
+type pushJob struct {
+	store   string
+	paths   []string
+	deps    []*pushJob
+	limit   *transferLimit
+	present bool
+	done    chan struct{}
+	err     error
+}
+
+func newPushGraph() *pushGraph {
+	return &pushGraph{jobs: make(map[string]*pushJob)}
+}
+
+// add adds a path to the job for a store, creating the job if necessary.
+func (graph *pushGraph) add(store, path string) *pushJob {
+	job, ok := graph.jobs[store]
+	if !ok {
+		job = &pushJob{store: store, done: make(chan struct{})}
+		graph.jobs[store] = job
+		graph.order = append(graph.order, store)
+	}
+	job.paths = append(job.paths, path)
+	return job
+}
+
+// after makes a job wait for another job to finish.
+func (job *pushJob) after(dep *pushJob) {
+	if dep == job {
+		return // an instance that is its own store.
+	}
+	for _, item := range job.deps {
+		if item == dep {
+			return
 		}
 	}
+	job.deps = append(job.deps, dep)
+}
 
-	for _, store := range stores {
-		err := inv.pushNixPaths(ctx, store, jobs[store]...)
+// check ensures that the graph has no cycles, such as two instances that use each other as a store.
+func (graph *pushGraph) check() error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[*pushJob]int, len(graph.jobs))
+	var visit func(job *pushJob) error
+	visit = func(job *pushJob) error {
+		switch state[job] {
+		case visiting:
+			return fmt.Errorf(`%q depends on itself through its stores`, job.store)
+		case visited:
+			return nil
+		}
+		state[job] = visiting
+		for _, dep := range job.deps {
+			err := visit(dep)
+			if err != nil {
+				return err
+			}
+		}
+		state[job] = visited
+		return nil
+	}
+	for _, store := range graph.order {
+		err := visit(graph.jobs[store])
 		if err != nil {
-			return fmt.Errorf(`%w while pushing to %q`, err, store)
+			return err
 		}
 	}
 	return nil
 }
 
-func (inv *Inventory) pushNixPaths(ctx context.Context, store string, paths ...string) error {
-	paths = uniqueStrings(paths)
-	args := make([]string, 0, len(paths)+8)
-	args = append(args, `copy`, `--to`, store, `--substitute-on-destination`)
-	opts := os.Getenv("NIX_COPYOPTS") //TODO: DOC this and NIX_SSHOPTS
-	if opts != `` {
-		args = append(args, strings.Split(opts, " ")...)
+// query asks whether each store already has the paths for its job, with at most n queries running at once.  Jobs for
+// stores that have their paths are skipped by run.
+func (graph *pushGraph) query(ctx context.Context, n int, fn func(ctx context.Context, store string, paths ...string) bool) {
+	if n < 1 {
+		n = 1
+	}
+	slots := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	for _, store := range graph.order {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(job *pushJob) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			job.present = fn(ctx, job.store, job.paths...)
+		}(graph.jobs[store])
+	}
+	wg.Wait()
+}
+
+// run runs each job in the graph with fn, with at most n jobs running at once, and no more than the limit for its
+// store allows.  A job whose dependencies failed is not run.
+func (graph *pushGraph) run(ctx context.Context, n int, fn func(ctx context.Context, store string, paths ...string) error) error {
+	if n < 1 {
+		n = 1
+	}
+	slots := make(chan struct{}, n)
+	for _, store := range graph.order {
+		go func(job *pushJob) {
+			defer close(job.done)
+			for _, dep := range job.deps {
+				<-dep.done
+				if dep.err != nil {
+					job.err = fmt.Errorf(`skipped because the push to %q failed`, dep.store)
+					return
+				}
+			}
+			if job.present {
+				inform(ctx, `%q already has its paths`, job.store)
+				report.addPush(&PushReport{Store: job.store, Paths: uniqueStrings(job.paths), Skipped: true})
+				return
+			}
+			if job.limit != nil && job.limit.slots != nil {
+				job.limit.slots <- struct{}{}
+				defer func() { <-job.limit.slots }()
+			}
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			job.err = fn(withTransferLimit(ctx, job.limit), job.store, job.paths...)
+		}(graph.jobs[store])
+	}
+
+	var failed []*pushJob
+	for _, store := range graph.order {
+		job := graph.jobs[store]
+		<-job.done
+		if job.err != nil {
+			failed = append(failed, job)
+		}
+	}
+	switch len(failed) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf(`%w while pushing to %q`, failed[0].err, failed[0].store)
 	}
-	args = append(args, paths...)
+	for _, job := range failed {
+		warn(ctx, `%v while pushing to %q`, job.err, job.store)
+	}
+	return fmt.Errorf(`%v pushes failed`, len(failed))
+}
 
-	inform(ctx, `running nix %v`, strings.Join(args, " "))
+// hasNixPaths reports whether a store has each of the paths.  Since a store only has a path if it has the path's
+// closure, this is enough to know that nothing needs to be copied.  Errors, such as an unreachable store, are treated
+// as missing paths, so that the copy will report them.
+func hasNixPaths(ctx context.Context, store string, paths ...string) bool {
+	args := append([]string{`path-info`, `--store`, store}, uniqueStrings(paths)...)
 	cmd := exec.CommandContext(ctx, `nix`, args...)
-	cmd.Env = append(os.Environ(), `NIX_SSHOPTS=-F `+filepath.Join(tmp, `ssh_config`)+` `+os.Getenv(`NIX_SSHOPTS`))
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	return cmd.Run()
+	cmd.Env = nixSSHEnv()
+	cmd.Stderr = logOutput(ctx, ioutil.Discard)
+	return cmd.Run() == nil
+}
+
+// nixSSHEnv returns the environment for a Nix command that may use SSH, so that it uses the generated ssh_config.  The
+// NIX_SSHOPTS environment variable may add options that override it.
+func nixSSHEnv() []string {
+	return append(os.Environ(), `NIX_SSHOPTS=-F `+filepath.Join(tmp, `ssh_config`)+` `+os.Getenv(`NIX_SSHOPTS`))
+}
+
+func (inv *Inventory) pushNixPaths(ctx context.Context, store string, paths ...string) (err error) {
+	paths = uniqueStrings(paths)
+	ctx, closeLog, err := withLog(ctx, store+`.push`)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	item := &PushReport{Store: store, Paths: paths, Log: logPath(ctx)}
+	defer func() {
+		item.Error = errorText(err)
+		report.addPush(item)
+	}()
+
+	args := inv.copyArgs(store, paths...)
+
+	item.Attempts, err = retry(ctx, `push to `+store, func() error {
+		inform(ctx, `running nix %v`, strings.Join(args, " "))
+		cmd := exec.CommandContext(ctx, `nix`, nixLogArgs(args)...)
+		cmd.Env = throttleEnv(ctx, store, nixSSHEnv())
+		progress := newProgress(ctx, `nix copy`)
+		defer progress.Close()
+		cmd.Stderr = progress
+		cmd.Stdout = logOutput(ctx, os.Stdout)
+		err := cmd.Run()
+		if err != nil && isConnectionFailure(progress.messages) {
+			return transientError{err}
+		}
+		return err
+	})
+	return err
 }
 
 func uniqueStrings(seq []string) []string {
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testGraph builds a push graph from edges like "instance>store", where the instance depends on the store.
+func testGraph(edges ...string) *pushGraph {
+	graph := newPushGraph()
+	for _, edge := range edges {
+		parts := strings.Split(edge, `>`)
+		job := graph.add(parts[0], `/nix/store/x-path`)
+		for _, dep := range parts[1:] {
+			job.after(graph.add(dep, `/nix/store/x-path`))
+		}
+	}
+	return graph
+}
+
+func TestPushGraphOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		edges   []string
+		present []string
+		failing []string
+		ran     []string
+		err     bool
+	}{
+		{`chain`, []string{`www>cache`, `cache>upstream`}, nil, nil, []string{`upstream`, `cache`, `www`}, false},
+		{`shared store`, []string{`a>cache`, `b>cache`}, nil, nil, []string{`cache`, `a`, `b`}, false},
+		{`present store is skipped`, []string{`a>cache`}, []string{`cache`}, nil, []string{`a`}, false},
+		{`failed store skips instances`, []string{`a>cache`, `b>cache`, `c`}, nil, []string{`cache`},
+			[]string{`cache`, `c`}, true},
+		{`failure deep in a chain`, []string{`a>mid`, `mid>top`}, nil, []string{`top`}, []string{`top`}, true},
+		{`own store`, []string{`a>a`}, nil, nil, []string{`a`}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			graph := testGraph(test.edges...)
+			for _, store := range test.present {
+				graph.jobs[store].present = true
+			}
+			var lock sync.Mutex
+			var ran []string
+			err := graph.run(context.Background(), 2, func(ctx context.Context, store string, paths ...string) error {
+				lock.Lock()
+				defer lock.Unlock()
+				for _, dep := range graph.jobs[store].deps {
+					if !dep.present && !contains(ran, dep.store) {
+						t.Errorf(`%q ran before %q`, store, dep.store)
+					}
+				}
+				ran = append(ran, store)
+				if contains(test.failing, store) {
+					return fmt.Errorf(`%v failed`, store)
+				}
+				return nil
+			})
+			if (err != nil) != test.err {
+				t.Errorf(`run returned %v, expected an error: %v`, err, test.err)
+			}
+			sort.Strings(ran)
+			want := append([]string(nil), test.ran...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(ran, want) {
+				t.Errorf(`ran %v, expected %v`, ran, want)
+			}
+		})
+	}
+}
+
+func TestPushGraphCheck(t *testing.T) {
+	tests := []struct {
+		edges []string
+		err   bool
+	}{
+		{[]string{`a>b`, `b>c`}, false},
+		{[]string{`a>a`}, false},
+		{[]string{`a>b`, `b>a`}, true},
+		{[]string{`a>b`, `b>c`, `c>a`}, true},
+	}
+	for _, test := range tests {
+		err := testGraph(test.edges...).check()
+		if (err != nil) != test.err {
+			t.Errorf(`check(%v) returned %v, expected an error: %v`, test.edges, err, test.err)
+		}
+	}
+}
+
+func TestPushGraphQuery(t *testing.T) {
+	graph := testGraph(`a>cache`, `b>cache`)
+	graph.query(context.Background(), 2, func(ctx context.Context, store string, paths ...string) bool {
+		return store == `cache`
+	})
+	for store, want := range map[string]bool{`cache`: true, `a`: false, `b`: false} {
+		if graph.jobs[store].present != want {
+			t.Errorf(`%q present is %v, expected %v`, store, graph.jobs[store].present, want)
+		}
+	}
+	if n := len(graph.jobs[`cache`].paths); n != 2 {
+		t.Errorf(`the shared store has %v paths, expected one from each instance`, n)
+	}
+}
+
+func contains(seq []string, item string) bool {
+	for _, x := range seq {
+		if x == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A Report describes what happened during a push or deployment, and where to find the logs for each step.  It is
+// written to report.json in the logs for the run.
+type Report struct {
+	// Run identifies the logs for the run, in the logs directory.
+	Run string `json:"run"`
+
+	// Builds describes each system, or target, built for the run.
+	Builds []*BuildReport `json:"builds,omitempty"`
+
+	// Pushes describes each transfer of paths to a store or instance.
+	Pushes []*PushReport `json:"pushes,omitempty"`
+
+	// Instances describes the activation of a system on each instance.
+	Instances []*InstanceReport `json:"instances,omitempty"`
+
+	lock sync.Mutex
+}
+
+// A BuildReport describes the build of a system, or one of its targets.
+type BuildReport struct {
+	System string `json:"system"`
+	Target string `json:"target"`
+	Result string `json:"result,omitempty"`
+	Log    string `json:"log,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// A PushReport describes the transfer of paths to a store.
+type PushReport struct {
+	Store    string   `json:"store"`
+	Paths    []string `json:"paths"`
+	Log      string   `json:"log,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Skipped  bool     `json:"skipped,omitempty"`
+	Attempts int      `json:"attempts,omitempty"`
+}
+
+// An InstanceReport describes the activation of a system on an instance.
+type InstanceReport struct {
+	Instance string `json:"instance"`
+	System   string `json:"system"`
+	Result   string `json:"result"`
+	Log      string `json:"log,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+}
+
+var report = Report{Run: runID}
+
+func (r *Report) addBuild(item *BuildReport) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Builds = append(r.Builds, item)
+}
+
+func (r *Report) addPush(item *PushReport) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Pushes = append(r.Pushes, item)
+}
+
+func (r *Report) addInstance(item *InstanceReport) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Instances = append(r.Instances, item)
+}
+
+// errorText returns the text of an error, or an empty string if err is nil.
+func errorText(err error) string {
+	if err == nil {
+		return ``
+	}
+	return err.Error()
+}
+
+// saveReport writes the report to the logs for the run, and summarizes it.
+func saveReport(ctx context.Context) error {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	if len(report.Builds) == 0 && len(report.Pushes) == 0 && len(report.Instances) == 0 {
+		return nil
+	}
+	dir := filepath.Join(logsPath, runID)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(&report, ``, `  `)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, `report.json`)
+	err = ioutil.WriteFile(path, append(data, '\n'), 0600)
+	if err != nil {
+		return err
+	}
+	for _, item := range report.Builds {
+		if item.Error != `` {
+			warn(ctx, `building %q for %q failed: %v, see %v`, item.Target, item.System, item.Error, item.Log)
+		}
+	}
+	for _, item := range report.Pushes {
+		if item.Error != `` {
+			warn(ctx, `push to %q failed: %v, see %v`, item.Store, item.Error, item.Log)
+		}
+	}
+	for _, item := range report.Instances {
+		if item.Error != `` {
+			warn(ctx, `deploying %q failed: %v, see %v`, item.Instance, item.Error, item.Log)
+		} else {
+			inform(ctx, `deployed %q to %q, see %v`, item.System, item.Instance, item.Log)
+		}
+	}
+	inform(ctx, `report written to %v`, path)
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+	rf := rootCmd.PersistentFlags()
+	rf.IntVar(&retries, `retries`, 3, `Number of times a push, activation or run is retried after a connection failure`)
+	rf.DurationVar(&retryDelay, `retry-delay`, 2*time.Second, `Delay before the first retry, doubled after each attempt`)
+}
+
+var retries = 3
+var retryDelay = 2 * time.Second
+
+// maxRetryDelay limits the delay between attempts, however many there are.
+const maxRetryDelay = time.Minute
+
+// A transientError is an error that may not recur if the operation is attempted again, such as a dropped connection.
+type transientError struct{ error }
+
+func (err transientError) Unwrap() error { return err.error }
+
+// retryable returns true if an operation that failed with err should be retried.  SSH exits with 255 when it cannot
+// reach the instance or loses its connection, which is distinct from a remote command that fails, such as an
+// activation that fails, which is not retried.
+func retryable(err error) bool {
+	var transient transientError
+	if errors.As(err, &transient) {
+		return true
+	}
+	var exit *exec.ExitError
+	return errors.As(err, &exit) && exit.ExitCode() == 255
+}
+
+// connectionFailures are found in messages from Nix when it loses its connection to a store.
+var connectionFailures = []string{
+	`connection reset`,
+	`connection closed`,
+	`connection refused`,
+	`connection timed out`,
+	`broken pipe`,
+	`unexpected end-of-file`,
+	`cannot connect`,
+	`could not resolve hostname`,
+}
+
+// isConnectionFailure returns true if any of the messages describe a lost connection.
+func isConnectionFailure(messages []string) bool {
+	for _, msg := range messages {
+		msg = strings.ToLower(msg)
+		for _, item := range connectionFailures {
+			if strings.Contains(msg, item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// retry calls fn until it succeeds, fails with an error that is not retryable, or has been retried --retries times,
+// waiting with an exponential backoff and jitter between attempts.  It returns the number of attempts made, and the
+// error from the last one.
+func retry(ctx context.Context, what string, fn func() error) (int, error) {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			inform(ctx, `attempt %v of %v`, attempt, what)
+		}
+		err := fn()
+		if err == nil || attempt > retries || !retryable(err) || ctx.Err() != nil {
+			return attempt, err
+		}
+		// wait between half and all of the delay, so parallel jobs that failed together do not retry together.
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		warn(ctx, `%v failed on attempt %v: %v, retrying in %v`, what, attempt, err, wait.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return attempt, err
+		case <-time.After(wait):
+		}
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
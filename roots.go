@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// rootLink returns the path of the GC root for a built system, creating the roots directory if necessary.  Nix
+// registers the link as an indirect root when it is used as an --out-link, so the result survives garbage collection
+// until the link is removed.
+func rootLink(system string) (string, error) {
+	err := os.MkdirAll(rootsDir(), 0700)
+	if err != nil {
+		return ``, err
+	}
+	return filepath.Abs(filepath.Join(rootsDir(), system))
+}
+
+// rootsDir returns the directory of GC roots given by --roots, or .hive.roots next to the state file.
+func rootsDir() string {
+	if rootsPath != `` {
+		return rootsPath
+	}
+	return filepath.Join(filepath.Dir(statePath), `.hive.roots`)
+}
+
+// dropRoot removes the GC root for a system, if there is one.
+func dropRoot(system string) error {
+	err := os.Remove(filepath.Join(rootsDir(), system))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// pruneRoots removes GC roots for systems, and their targets, that are no longer in the inventory.
+func pruneRoots() error {
+	entries, err := os.ReadDir(rootsDir())
+	switch {
+	case err == nil:
+	case os.IsNotExist(err):
+		return nil // nothing has been built yet.
+	default:
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Type()&os.ModeSymlink == 0 {
+			continue // not one of ours.
+		}
+		system := entry.Name()
+		if ix := strings.LastIndexByte(system, '@'); ix != -1 {
+			system = system[:ix] // a root for one of the system's targets.
+		}
+		if _, ok := inv.Systems[system]; ok {
+			continue
+		}
+		err := dropRoot(entry.Name())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
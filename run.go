@@ -1,33 +1,68 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 
 	"github.com/spf13/cobra"
 )
 
 func init() {
 	rootCmd.AddCommand(runCmd)
+	rf := runCmd.Flags()
+	rf.SetInterspersed(false)
+	rf.IntVar(&runParallel, `parallel`, 1, `Number of instances to run the command on at once`)
+	rf.BoolVar(&runGroup, `group`, false, `Print the output from each instance as one block when it finishes`)
+	rf.BoolVar(&runAggregate, `aggregate`, false, `Group instances with the same output and exit status`)
+	rf.BoolVar(&runJSON, `json`, false, `Write the aggregated results as JSON, implying --aggregate`)
+	rf.StringVar(&runShell, `shell`, ``, `Nix file with a mkShell environment to run the command in`)
+	rf.BoolVar(&runFailFast, `fail-fast`, false, `Stop starting the command on more instances once it fails on one`)
 }
 
 var runCmd = &cobra.Command{
-	Use:   `run`,
+	Use:   `run [flags] [user@]pattern command...`,
 	Short: `Runs a command on managed hosts.`,
-	Long:  `Run runs a command on managed hosts in an optional Nix shell`,
-	RunE:  runCommand,
+	Long: `Run runs a command on managed hosts in an optional Nix shell.
+
+By default, the command runs on one instance at a time, after a "## instance" header.  With --parallel, it runs on
+several instances at once, and each line of output is prefixed with the name of its instance.  With --group, the
+output from each instance is printed as one block when the command finishes there.  With --aggregate, the output is
+held until the command has finished everywhere, and instances with the same stdout, stderr and exit status are listed
+together, or written as JSON with --json.  Stdin is only forwarded to the command when the pattern matches a single
+instance.  The command runs on every instance even if it fails on some, unless --fail-fast stops it from starting on
+more once it has failed.
+
+With --shell, the command runs inside the environment of a Nix shell made with mkShell, like nix-shell would enter.
+The shell is built locally and pushed to each instance through its stores, so tools used for debugging do not need
+to be part of the system.
+
+With --script, a local script is copied to each instance, run with the remaining arguments, and removed afterwards.
+With --script-nix, the script is a package, such as one made with writeShellApplication, which is built locally and
+pushed to each instance with its dependencies, then its program is run.  Either may be run as root with --sudo.`,
+	RunE: runCommand,
 }
 
+var runParallel = 1
+var runGroup = false
+var runAggregate = false
+var runJSON = false
+var runShell = ``
+var runFailFast = false
+
 func runCommand(cmd *cobra.Command, args []string) error {
 	ctx := cmd.Context()
-	if len(args) < 2 {
-		return fmt.Errorf(`run expects an instance pattern followed by a command to run`)
+	script := runScript != `` || runScriptNix != ``
+	if len(args) < 1 || len(args) < 2 && !script {
+		return fmt.Errorf(`run expects an instance pattern followed by a command to run, or a --script`)
 	}
-	//TODO: support user@pattern
-	pattern, command := args[0], args[1:]
+	user, pattern := splitUser(args[0])
+	command := commandArgs(args[1:])
 	instances, err := inv.matchInstances(pattern)
 	if err != nil {
 		return err
@@ -36,32 +71,239 @@ func runCommand(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
-	failed := 0
-	for _, instance := range instances {
-		println(`##`, instance)
-		err := runCommandOn(ctx, instance, command)
+	var prefix []string
+	if runShell != `` {
+		shell, err := buildShell(ctx, runShell)
 		if err != nil {
-			println(`!!`, err.Error())
+			return err
+		}
+		err = inv.push(ctx, instances, shell)
+		if err != nil {
+			return err
+		}
+		prefix = []string{shell + `/bin/hive-shell`}
+	}
+	if script {
+		return runScriptOn(ctx, user, instances, prefix, command)
+	}
+	command = append(prefix, command...)
+	return runOnInstances(ctx, instances,
+		func(ctx context.Context, instance string, stdin io.Reader, stdout, stderr io.Writer) error {
+			return runCommandOn(ctx, joinUser(user, instance), command, stdin, stdout, stderr)
+		})
+}
+
+// commandArgs returns the command, or the arguments for a script, that follow the pattern.  Since flags stop at the
+// pattern, a "--" after it is kept by cobra, but it only separates the command from the flags, like one before it.
+func commandArgs(args []string) []string {
+	if len(args) > 0 && args[0] == `--` {
+		return args[1:]
+	}
+	return args
+}
+
+// A runFunc runs something on an instance, with its input and output connected to stdin, stdout and stderr.
+type runFunc func(ctx context.Context, instance string, stdin io.Reader, stdout, stderr io.Writer) error
+
+// runOnInstances calls fn for each instance, up to --parallel at a time, with output arranged as --group asks, and
+// reports how many instances failed.  With --fail-fast, instances that have not started when one fails are skipped.
+// Stdin is only given to fn when there is a single instance, since there is no sensible way to share it.
+func runOnInstances(ctx context.Context, instances []string, fn runFunc) error {
+	var stdin io.Reader
+	if len(instances) == 1 {
+		stdin = os.Stdin
+	}
+	n := runParallel
+	if n < 1 {
+		n = 1
+	}
+	var lock sync.Mutex // held while writing output, so lines and blocks are not interleaved.
+	slots := make(chan struct{}, n)
+	outputs := make([]*runOutput, len(instances))
+	var failing int32
+	skipped := 0
+	var wg sync.WaitGroup
+	for ix, instance := range instances {
+		slots <- struct{}{}
+		if runFailFast && atomic.LoadInt32(&failing) != 0 {
+			<-slots
+			skipped++
+			continue
+		}
+		wg.Add(1)
+		go func(ix int, instance string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			out := newRunOutput(instance, n > 1, &lock)
+			out.finish(fn(ctx, instance, stdin, out.stdout, out.stderr))
+			if out.err != nil {
+				atomic.StoreInt32(&failing, 1)
+			}
+			outputs[ix] = out
+		}(ix, instance)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, out := range outputs {
+		if out != nil && out.err != nil {
 			failed++
 		}
 	}
-	switch failed {
-	case 0:
+	if runAggregate || runJSON {
+		err := writeAggregate(os.Stdout, aggregateResults(outputs))
+		if err != nil {
+			return err
+		}
+	}
+	switch {
+	case skipped > 0:
+		return fmt.Errorf(`%v instances failed, and %v were skipped`, failed, skipped)
+	case failed == 0:
 		return nil
-	case 1:
+	case failed == 1:
 		return fmt.Errorf(`one instance failed`)
 	}
 	return fmt.Errorf(`%v instances failed`, failed)
 }
 
-func runCommandOn(ctx context.Context, instance string, command []string) error {
-	proc := exec.CommandContext(ctx, `ssh`, append([]string{
-		`-F`, filepath.Join(tmp, `ssh_config`), instance,
-	}, command...)...)
-	proc.Stdout = os.Stdout
-	proc.Stderr = os.Stderr
-	proc.Stdin = os.Stdin
-	return proc.Run()
+// runCommandOn runs a command with ssh, where destination is an instance, optionally preceded by "user@".  The
+// command is retried if the connection fails, unless it is given stdin, which a failed attempt may have consumed.
+func runCommandOn(
+	ctx context.Context, destination string, command []string, stdin io.Reader, stdout, stderr io.Writer,
+) error {
+	args := append([]string{destination}, command...)
+	if stdin != nil {
+		return openSSH(ctx, `ssh`, args, stdin, stdout, stderr)
+	}
+	_, err := retry(ctx, `running on `+destination, func() error {
+		resetOutput(stdout, stderr)
+		return openSSH(ctx, `ssh`, args, nil, stdout, stderr)
+	})
+	return err
+}
+
+// resetOutput discards the output held back from a failed attempt, such as for --group or --aggregate, so it is not
+// mixed with the output of the next attempt.  Output that has already been written cannot be taken back.
+func resetOutput(writers ...io.Writer) {
+	for _, w := range writers {
+		if w, ok := w.(interface{ Reset() }); ok {
+			w.Reset()
+		}
+	}
+}
+
+// A runOutput arranges the output from an instance: written directly after a header when instances take turns,
+// prefixed with the instance name when they run at once, collected into a block with --group, or captured with
+// --aggregate.
+type runOutput struct {
+	instance string
+	lock     *sync.Mutex
+	block    *bytes.Buffer
+	prefixes []*prefixWriter
+	captured []*bytes.Buffer
+	stdout   io.Writer
+	stderr   io.Writer
+	err      error
+}
+
+func newRunOutput(instance string, parallel bool, lock *sync.Mutex) *runOutput {
+	out := &runOutput{instance: instance, lock: lock}
+	switch {
+	case runAggregate || runJSON:
+		stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+		out.captured = []*bytes.Buffer{stdout, stderr}
+		out.stdout, out.stderr = stdout, stderr
+	case runGroup:
+		out.block = new(bytes.Buffer)
+		w := &syncWriter{w: out.block}
+		out.stdout, out.stderr = w, w
+	case parallel:
+		stdout := &prefixWriter{prefix: instance + `: `, out: os.Stdout, lock: lock}
+		stderr := &prefixWriter{prefix: instance + `: `, out: os.Stderr, lock: lock}
+		out.prefixes = []*prefixWriter{stdout, stderr}
+		out.stdout, out.stderr = stdout, stderr
+	default:
+		fmt.Fprintln(os.Stderr, `##`, instance)
+		out.stdout, out.stderr = os.Stdout, os.Stderr
+	}
+	return out
+}
+
+// finish writes any output that has been held back, and the error, if there is one.
+func (out *runOutput) finish(err error) {
+	out.err = err
+	for _, w := range out.prefixes {
+		w.flush()
+	}
+	out.lock.Lock()
+	defer out.lock.Unlock()
+	switch {
+	case out.captured != nil: // written by writeAggregate.
+	case out.block != nil:
+		fmt.Fprintln(os.Stdout, `##`, out.instance)
+		os.Stdout.Write(out.block.Bytes())
+		if err != nil {
+			fmt.Fprintln(os.Stdout, `!!`, err.Error())
+		}
+	case err == nil:
+	case out.prefixes != nil:
+		fmt.Fprintf(os.Stderr, "%v: !! %v\n", out.instance, err)
+	default:
+		fmt.Fprintln(os.Stderr, `!!`, err.Error())
+	}
+}
+
+// A prefixWriter writes each complete line with a prefix, holding a lock so lines from several writers are not mixed.
+type prefixWriter struct {
+	prefix  string
+	out     io.Writer
+	lock    *sync.Mutex
+	partial []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	ix := bytes.LastIndexByte(w.partial, '\n')
+	if ix == -1 {
+		return len(p), nil
+	}
+	w.lock.Lock()
+	for _, line := range bytes.SplitAfter(w.partial[:ix+1], []byte("\n")) {
+		if len(line) > 0 {
+			io.WriteString(w.out, w.prefix)
+			w.out.Write(line)
+		}
+	}
+	w.lock.Unlock()
+	w.partial = append([]byte(nil), w.partial[ix+1:]...)
+	return len(p), nil
+}
+
+// flush writes an incomplete last line, if there is one.
+func (w *prefixWriter) flush() {
+	if len(w.partial) > 0 {
+		w.Write([]byte("\n"))
+	}
+}
+
+// A syncWriter serializes writes to a writer shared by stdout and stderr.
+type syncWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	return w.w.Write(p)
+}
+
+// Reset resets the underlying writer, if it can be.
+func (w *syncWriter) Reset() {
+	w.Lock()
+	defer w.Unlock()
+	resetOutput(w.w)
 }
 
 // buildShell builds a Nix expression at path similar to how nix-shell does it and returns a path to it in the Nix
@@ -70,8 +312,6 @@ func buildShell(ctx context.Context, path string) (string, error) {
 	// https://github.com/NixOS/nix/blob/27444d40cf726129334899a42d68d69f73baa988/src/nix-build/nix-build.cc
 	// https://github.com/NixOS/nixpkgs/blob/master/pkgs/build-support/mkshell/default.nix
 
-	panic(`TODO`)
-
 	// mkshell produces an intentionally broken derivation which is treated specially by nix / nix-build / nix-shell
 	// to produce a file like:
 	/*
@@ -97,7 +337,44 @@ func buildShell(ctx context.Context, path string) (string, error) {
 	// This file is run with "bash --rcfile /tmp/nix-shell-38231-0/rc" and it, along with the tempdir, is removed
 	// by the parent process after bash exits.
 	//
-	// In order to replicate this in a more maintainable way, we have <nix/shell.nix> that overlays pkgs.mkShell with
-	// our own variant that has its own phases and buildPhase that captures the build environment.  (We assume that all
-	// the complexity in nix-build.cc is a vestige meant to allow hacking on unbuilt derivations.)
+	// In order to replicate this in a more maintainable way, we have <hive/shell.nix> that overrides the derivation
+	// from pkgs.mkShell with its own phases and a buildPhase that captures the build environment in $out/rc, along
+	// with $out/bin/hive-shell, which sources it and runs a command.  (We assume that all the complexity in
+	// nix-build.cc is a vestige meant to allow hacking on unbuilt derivations.)
+	return buildFile(ctx, `shell`, path, `(import <hive/shell.nix>)`)
+}
+
+// buildFile builds an expression, such as <hive/shell.nix>, for a Nix file at path, with the top level paths of the
+// deployment, and returns the result, signed with the signing key.  The result has a GC root until Nix-Hive exits, so
+// it can be pushed.
+func buildFile(ctx context.Context, name, path, expr string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return ``, err
+	}
+	ctx, closeLog, err := withLog(ctx, name+`.build`)
+	if err != nil {
+		return ``, err
+	}
+	defer closeLog()
+	inform(ctx, `building the %v in %v`, name, path)
+	link := filepath.Join(tmp, name)
+	args := []string{`build`, `--out-link`, link, `--argstr`, `path`, abs}
+	for _, item := range inv.Paths {
+		args = append(args, `--include`, item)
+	}
+	deployment, err := deploymentArgs(expr)
+	if err != nil {
+		return ``, err
+	}
+	_, err = execNix(ctx, append(args, deployment...)...)
+	if err != nil {
+		return ``, fmt.Errorf(`%w while building the %v in %v`, err, name, path)
+	}
+	result, err := os.Readlink(link)
+	if err != nil {
+		return ``, err
+	}
+	// like a system, the result must be signed for stores and instances that require signatures.
+	return result, inv.sign(ctx, result)
 }
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCommandArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{`uptime`}, []string{`uptime`}},
+		{[]string{`--`, `--dry-run`}, []string{`--dry-run`}},
+		{[]string{`--`, `ls`, `--`, `-l`}, []string{`ls`, `--`, `-l`}},
+		{[]string{`--`, `--`}, []string{`--`}},
+		{[]string{`--`}, []string{}},
+		{nil, nil},
+	}
+	for _, test := range tests {
+		got := commandArgs(test.args)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf(`commandArgs(%q) = %q, expected %q`, test.args, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(sbomCmd)
+	sbomCmd.Flags().StringVar(&sbomFormat, `format`, `cyclonedx`, `SBOM format, either "cyclonedx" or "spdx"`)
+	sbomCmd.Flags().StringVarP(&sbomOutput, `output`, `o`, ``, `Directory for SBOM files, instead of stdout`)
+	buildCmd.Flags().StringVar(&buildSBOM, `sbom`, ``, `Directory where an SBOM is written for each built system`)
+	buildCmd.Flags().StringVar(&sbomFormat, `sbom-format`, `cyclonedx`, `SBOM format, either "cyclonedx" or "spdx"`)
+}
+
+var sbomCmd = &cobra.Command{
+	Use:   `sbom [systems]`,
+	Short: `Describes the contents of built systems as a software bill of materials`,
+	Long: `SBOM builds systems and writes a CycloneDX or SPDX document for each, listing every store path in the
+closure of the system with its package name and version from the derivation that produced it, its deriver and,
+where the configuration names the package directly, its licenses.  With --output, each document is written to a
+file named after the system.`,
+	RunE: runSBOM,
+}
+
+var sbomFormat = `cyclonedx`
+var sbomOutput = ``
+var buildSBOM = ``
+
+func runSBOM(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	systems, err := inv.matchSystems(args...)
+	if err != nil {
+		return err
+	}
+	err = inv.build(ctx, systems...)
+	if err != nil {
+		return err
+	}
+	return inv.writeSBOMs(ctx, sbomOutput, systems...)
+}
+
+// writeSBOMs writes an SBOM for each system to a file in dir, or to stdout if dir is empty.
+func (inv *Inventory) writeSBOMs(ctx context.Context, dir string, systems ...string) error {
+	if sbomFormat != `cyclonedx` && sbomFormat != `spdx` {
+		return fmt.Errorf(`SBOM format %q is not "cyclonedx" or "spdx"`, sbomFormat)
+	}
+	for _, system := range systems {
+		doc, err := inv.sbom(ctx, system)
+		if err != nil {
+			return fmt.Errorf(`%w while describing %q`, err, system)
+		}
+		if dir == `` {
+			err = writeJSON(os.Stdout, doc)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, system+`.`+sbomFormat+`.json`)
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		err = writeJSON(f, doc)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		inform(ctx, `wrote SBOM for %q to %v`, system, path)
+	}
+	return nil
+}
+
+func writeJSON(w io.Writer, doc interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent(``, `  `)
+	return enc.Encode(doc)
+}
+
+// A sbomPackage is a store path in the closure of a system.
+type sbomPackage struct {
+	PathInfo
+	name     string
+	version  string
+	licenses []sbomLicense
+}
+
+// A sbomLicense is a license from the metadata of a package in Nixpkgs, as described by <hive/licenses.nix>.
+type sbomLicense struct {
+	// ID is the SPDX identifier for the license, if Nixpkgs has one.
+	ID       string `json:"id,omitempty"`
+	Name     string `json:"name"`
+	FullName string `json:"fullName"`
+	URL      string `json:"url,omitempty"`
+}
+
+// ref returns an SPDX license reference for a license that does not have an SPDX identifier.
+func (l sbomLicense) ref() string {
+	return `LicenseRef-` + spdxRef(l.Name)
+}
+
+func (inv *Inventory) sbom(ctx context.Context, system string) (interface{}, error) {
+	result := inv.Systems[system].Result
+	closure, err := closureInfo(ctx, result)
+	if err != nil {
+		return nil, err
+	}
+	licenses, err := inv.systemLicenses(ctx, system)
+	if err != nil {
+		return nil, err
+	}
+	derivers := make([]string, 0, len(closure))
+	for _, info := range closure {
+		derivers = append(derivers, info.Deriver)
+	}
+	drvs, err := derivationInfo(ctx, derivers...)
+	if err != nil {
+		return nil, err
+	}
+	pkgs := make([]sbomPackage, len(closure))
+	for i, info := range closure {
+		pkg := &pkgs[i]
+		pkg.PathInfo = info
+		drv, ok := drvs[info.Deriver]
+		switch {
+		case ok && drv.Env.PName != ``:
+			pkg.name, pkg.version = drv.Env.PName, drv.Env.Version
+		case ok && drv.Env.Name != ``:
+			pkg.name, pkg.version = parseDrvName(drv.Env.Name)
+		default:
+			// the derivation is not in the store, such as for a path substituted from a cache.
+			pkg.name, pkg.version = parseDrvName(storePathName(info.Path))
+		}
+		pkg.licenses = licenses[info.Path]
+	}
+	if sbomFormat == `spdx` {
+		return spdxDocument(system, result, pkgs), nil
+	}
+	return cycloneDXDocument(system, result, pkgs), nil
+}
+
+// A Derivation is the part of a derivation, as described by "nix show-derivation", that names its package.
+type Derivation struct {
+	Env struct {
+		Name    string `json:"name"`
+		PName   string `json:"pname"`
+		Version string `json:"version"`
+	} `json:"env"`
+}
+
+// derivationInfo describes the derivations that are in the local store, by path.
+func derivationInfo(ctx context.Context, drvs ...string) (map[string]Derivation, error) {
+	present := make([]string, 0, len(drvs))
+	for _, drv := range uniqueStrings(drvs) {
+		if drv != `` && pathExists(drv) {
+			present = append(present, drv)
+		}
+	}
+	info := make(map[string]Derivation, len(present))
+	const batch = 500 // keeps the arguments for each call well within the limits of the OS.
+	for len(present) > 0 {
+		n := len(present)
+		if n > batch {
+			n = batch
+		}
+		data, err := execNix(ctx, append([]string{`show-derivation`}, present[:n]...)...)
+		if err != nil {
+			return nil, fmt.Errorf(`%w while reading derivations`, err)
+		}
+		err = json.Unmarshal(data, &info)
+		if err != nil {
+			return nil, err
+		}
+		present = present[n:]
+	}
+	return info, nil
+}
+
+// systemLicenses evaluates <hive/licenses.nix> for a system, mapping output paths to their licenses.
+func (inv *Inventory) systemLicenses(ctx context.Context, system string) (map[string][]sbomLicense, error) {
+	args, err := inv.systemArgs(system, `(import <hive/licenses.nix>)`)
+	if err != nil {
+		return nil, err
+	}
+	data, err := execNix(ctx, append([]string{`eval`, `--json`}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	var licenses map[string][]sbomLicense
+	err = json.Unmarshal(data, &licenses)
+	return licenses, err
+}
+
+// sbomSerial derives a stable identifier for the SBOM of a system result, formatted as a UUID.
+func sbomSerial(result string) string {
+	sum := sha256.Sum256([]byte(result))
+	sum[6] = sum[6]&0x0f | 0x50 // "version 5", a name-based UUID.
+	sum[8] = sum[8]&0x3f | 0x80
+	return fmt.Sprintf(`%x-%x-%x-%x-%x`, sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+func cycloneDXDocument(system, result string, pkgs []sbomPackage) interface{} {
+	type property struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	type license struct {
+		License struct {
+			ID   string `json:"id,omitempty"`
+			Name string `json:"name,omitempty"`
+		} `json:"license"`
+	}
+	type component struct {
+		Type       string     `json:"type"`
+		Ref        string     `json:"bom-ref"`
+		Name       string     `json:"name"`
+		Version    string     `json:"version,omitempty"`
+		Licenses   []license  `json:"licenses,omitempty"`
+		Properties []property `json:"properties,omitempty"`
+	}
+	type dependency struct {
+		Ref       string   `json:"ref"`
+		DependsOn []string `json:"dependsOn,omitempty"`
+	}
+
+	root := component{Type: `operating-system`, Ref: result, Name: system}
+	components := make([]component, 0, len(pkgs))
+	dependencies := make([]dependency, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		item := component{Type: `library`, Ref: pkg.Path, Name: pkg.name, Version: pkg.version}
+		for _, info := range pkg.licenses {
+			var l license
+			if info.ID != `` {
+				l.License.ID = info.ID
+			} else {
+				l.License.Name = info.FullName
+			}
+			item.Licenses = append(item.Licenses, l)
+		}
+		item.Properties = append(item.Properties, property{`nix:store_path`, pkg.Path})
+		if pkg.Deriver != `` {
+			item.Properties = append(item.Properties, property{`nix:deriver`, pkg.Deriver})
+		}
+		if pkg.NarHash != `` {
+			item.Properties = append(item.Properties, property{`nix:nar_hash`, pkg.NarHash})
+		}
+		dependencies = append(dependencies, dependency{pkg.Path, otherReferences(pkg)})
+		if pkg.Path == result {
+			// the result is the subject of the document, so it is described in the metadata instead; bom-refs must be
+			// unique.
+			item.Type, item.Name = `operating-system`, system
+			root = item
+			continue
+		}
+		components = append(components, item)
+	}
+
+	return map[string]interface{}{
+		`bomFormat`:    `CycloneDX`,
+		`specVersion`:  `1.4`,
+		`serialNumber`: `urn:uuid:` + sbomSerial(result),
+		`version`:      1,
+		`metadata`: map[string]interface{}{
+			`timestamp`: time.Now().UTC().Format(time.RFC3339),
+			`tools`:     []map[string]string{{`name`: `nix-hive`}},
+			`component`: root,
+		},
+		`components`:   components,
+		`dependencies`: dependencies,
+	}
+}
+
+func spdxDocument(system, result string, pkgs []sbomPackage) interface{} {
+	type packageInfo struct {
+		ID               string `json:"SPDXID"`
+		Name             string `json:"name"`
+		Version          string `json:"versionInfo,omitempty"`
+		DownloadLocation string `json:"downloadLocation"`
+		LicenseConcluded string `json:"licenseConcluded"`
+		LicenseDeclared  string `json:"licenseDeclared"`
+		CopyrightText    string `json:"copyrightText"`
+		FilesAnalyzed    bool   `json:"filesAnalyzed"`
+		Comment          string `json:"comment,omitempty"`
+	}
+	type relationship struct {
+		Element string `json:"spdxElementId"`
+		Type    string `json:"relationshipType"`
+		Related string `json:"relatedSpdxElement"`
+	}
+	// licenses without SPDX identifiers must be described in the document to be referred to.
+	type extractedLicense struct {
+		ID       string   `json:"licenseId"`
+		Name     string   `json:"name"`
+		Text     string   `json:"extractedText"`
+		SeeAlsos []string `json:"seeAlsos,omitempty"`
+	}
+
+	packages := make([]packageInfo, 0, len(pkgs))
+	relationships := []relationship{{`SPDXRef-DOCUMENT`, `DESCRIBES`, spdxID(result)}}
+	extracted := make(map[string]extractedLicense)
+	for _, pkg := range pkgs {
+		declared := `NOASSERTION`
+		if len(pkg.licenses) > 0 {
+			ids := make([]string, 0, len(pkg.licenses))
+			for _, info := range pkg.licenses {
+				id := info.ID
+				if id == `` {
+					id = info.ref()
+					item := extractedLicense{ID: id, Name: info.FullName, Text: info.FullName}
+					if info.URL != `` {
+						item.SeeAlsos = []string{info.URL}
+					}
+					extracted[id] = item
+				}
+				ids = append(ids, id)
+			}
+			declared = strings.Join(ids, ` AND `)
+		}
+		comment := `store path ` + pkg.Path
+		if pkg.Deriver != `` {
+			comment += `, derived from ` + pkg.Deriver
+		}
+		packages = append(packages, packageInfo{
+			ID:               spdxID(pkg.Path),
+			Name:             pkg.name,
+			Version:          pkg.version,
+			DownloadLocation: `NOASSERTION`,
+			LicenseConcluded: `NOASSERTION`,
+			LicenseDeclared:  declared,
+			CopyrightText:    `NOASSERTION`,
+			Comment:          comment,
+		})
+		for _, ref := range otherReferences(pkg) {
+			relationships = append(relationships, relationship{spdxID(pkg.Path), `DEPENDS_ON`, spdxID(ref)})
+		}
+	}
+
+	refs := make([]string, 0, len(extracted))
+	for id := range extracted {
+		refs = append(refs, id)
+	}
+	sort.Strings(refs)
+	extractedLicenses := make([]extractedLicense, 0, len(refs))
+	for _, id := range refs {
+		extractedLicenses = append(extractedLicenses, extracted[id])
+	}
+
+	return map[string]interface{}{
+		`spdxVersion`:       `SPDX-2.3`,
+		`dataLicense`:       `CC0-1.0`,
+		`SPDXID`:            `SPDXRef-DOCUMENT`,
+		`name`:              system,
+		`documentNamespace`: `https://github.com/threatgrid/nix-hive/spdx/` + sbomSerial(result),
+		`creationInfo`: map[string]interface{}{
+			`created`:  time.Now().UTC().Format(time.RFC3339),
+			`creators`: []string{`Tool: nix-hive`},
+		},
+		`packages`:                   packages,
+		`relationships`:              relationships,
+		`hasExtractedLicensingInfos`: extractedLicenses,
+	}
+}
+
+// otherReferences returns the references of a package other than itself, in order.
+func otherReferences(pkg sbomPackage) []string {
+	refs := make([]string, 0, len(pkg.References))
+	for _, ref := range pkg.References {
+		if ref != pkg.Path {
+			refs = append(refs, ref)
+		}
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// spdxID returns an SPDX identifier for a store path, using its hash.
+func spdxID(path string) string {
+	base := path[strings.LastIndexByte(path, '/')+1:]
+	if ix := strings.IndexByte(base, '-'); ix != -1 {
+		base = base[:ix]
+	}
+	return `SPDXRef-` + base
+}
+
+// spdxRef replaces characters that are not allowed in an SPDX reference.
+func spdxRef(text string) string {
+	return strings.Map(func(ch rune) rune {
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9', ch == '.', ch == '-':
+			return ch
+		}
+		return '-'
+	}, text)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestCycloneDXRefs(t *testing.T) {
+	const (
+		system = `/nix/store/aaaa-nixos-system-web-21.05`
+		etc    = `/nix/store/bbbb-etc`
+		glibc  = `/nix/store/cccc-glibc-2.32-46`
+	)
+	pkgs := []sbomPackage{
+		{PathInfo: PathInfo{Path: system, References: []string{etc, glibc, system}}, name: `nixos-system-web`},
+		{PathInfo: PathInfo{Path: etc, References: []string{glibc}}, name: `etc`},
+		{PathInfo: PathInfo{Path: glibc, References: []string{glibc}}, name: `glibc`, version: `2.32-46`,
+			licenses: []sbomLicense{{ID: `LGPL-2.1-or-later`, Name: `lgpl21Plus`}}},
+	}
+	var buf bytes.Buffer
+	err := writeJSON(&buf, cycloneDXDocument(`web`, system, pkgs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type component struct {
+		Ref  string `json:"bom-ref"`
+		Type string `json:"type"`
+		Name string `json:"name"`
+	}
+	var doc struct {
+		Metadata struct {
+			Component component `json:"component"`
+		} `json:"metadata"`
+		Components   []component `json:"components"`
+		Dependencies []struct {
+			Ref       string   `json:"ref"`
+			DependsOn []string `json:"dependsOn"`
+		} `json:"dependencies"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.Metadata.Component.Ref != system || doc.Metadata.Component.Type != `operating-system` ||
+		doc.Metadata.Component.Name != `web` {
+		t.Errorf(`the metadata component is %#v, expected the operating system %q`, doc.Metadata.Component, system)
+	}
+	refs := map[string]bool{doc.Metadata.Component.Ref: true}
+	for _, item := range doc.Components {
+		if refs[item.Ref] {
+			t.Errorf(`bom-ref %q is not unique`, item.Ref)
+		}
+		refs[item.Ref] = true
+	}
+	if len(refs) != len(pkgs) {
+		t.Errorf(`the document has %v bom-refs, expected %v`, len(refs), len(pkgs))
+	}
+	for _, dep := range doc.Dependencies {
+		for _, ref := range append([]string{dep.Ref}, dep.DependsOn...) {
+			if !refs[ref] {
+				t.Errorf(`dependency on %q does not refer to a component`, ref)
+			}
+		}
+	}
+}
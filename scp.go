@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"strings"
 
 	"github.com/spf13/cobra"
 )
@@ -16,20 +18,88 @@ func init() {
 var scpCmd = &cobra.Command{
 	Use:   `scp`,
 	Short: `Exchanges files with a managed instance via SCP`,
-	Long:  `scp will generate an scp config and use it with your arguments`,
-	RunE:  runSCP,
+	Long: `scp will generate an scp config and use it with your arguments.
+
+Hosts in remote paths may be patterns, such as "www-*:/tmp/" or "root@tag:web:/tmp/".  A file may be copied to
+every instance matching the destination, but a source must match a single instance.  Hosts that do not match any
+instance are passed to scp as they are.`,
+	RunE: runSCP,
 }
 
+// scpOptionArgs lists the scp options that take an argument.
+const scpOptionArgs = `cDFiJloPSX`
+
 func runSCP(cmd *cobra.Command, args []string) error {
-	err := generateSshConfig(cmd.Context())
+	ctx := cmd.Context()
+	err := generateSshConfig(ctx)
 	if err != nil {
 		return err
 	}
-	proc := exec.CommandContext(cmd.Context(), `scp`, append([]string{
-		`-F`, filepath.Join(tmp, `ssh_config`),
-	}, args...)...)
-	proc.Stdout = os.Stdout
-	proc.Stderr = os.Stderr
-	proc.Stdin = os.Stdin
-	return proc.Run()
+	args = append([]string(nil), args...)
+	first := firstOperand(args, scpOptionArgs)
+	fanOut, fanOutIx := []string(nil), -1
+	for ix := first; ix >= 0 && ix < len(args); ix++ {
+		user, host, path, ok := scpRemote(args[ix])
+		if !ok {
+			continue
+		}
+		instances, ok := inv.resolveInstances(host)
+		switch {
+		case !ok:
+			continue
+		case len(instances) == 1:
+			args[ix] = joinUser(user, instances[0]) + `:` + path
+			continue
+		case ix != len(args)-1:
+			return fmt.Errorf(`%q matches %v instances, but files can only be copied from one`, host, len(instances))
+		}
+		fanOut, fanOutIx = instances, ix
+	}
+	if fanOut == nil {
+		return openSSH(ctx, `scp`, args, os.Stdin, os.Stdout, os.Stderr)
+	}
+	user, _, path, _ := scpRemote(args[fanOutIx])
+	return runOnInstances(ctx, fanOut,
+		func(ctx context.Context, instance string, stdin io.Reader, stdout, stderr io.Writer) error {
+			seq := append([]string(nil), args...)
+			seq[fanOutIx] = joinUser(user, instance) + `:` + path
+			return openSSH(ctx, `scp`, seq, stdin, stdout, stderr)
+		})
+}
+
+// scpRemote splits an scp operand like "user@host:path" into its parts, or returns false if it is a local path.
+// Hosts qualified with "tag:" or "system:" extend to the second colon, so "tag:web:/tmp/" copies to "/tmp/" on the
+// instances tagged "web".
+func scpRemote(operand string) (user, host, path string, ok bool) {
+	rest := operand
+	if ix := strings.IndexByte(rest, '@'); ix != -1 && !strings.ContainsAny(rest[:ix], `:/`) {
+		user, rest = rest[:ix], rest[ix+1:]
+	}
+	skip := 0
+	for _, qualifier := range []string{`tag:`, `system:`} {
+		if strings.HasPrefix(rest, qualifier) {
+			skip = len(qualifier)
+		}
+	}
+	ix := strings.IndexByte(rest[skip:], ':')
+	if ix == -1 {
+		return ``, ``, ``, false
+	}
+	host, path = rest[:skip+ix], rest[skip+ix+1:]
+	switch {
+	case host == `` || strings.ContainsRune(host, '/'):
+		return ``, ``, ``, false // like scp, a colon after a slash is part of a local path.
+	case user == `` && isDrivePath(host, path):
+		return ``, ``, ``, false
+	}
+	return user, host, path, true
+}
+
+// isDrivePath reports whether a host and path split from an operand are a Windows path like "C:/x" or "C:\x".
+func isDrivePath(host, path string) bool {
+	if len(host) != 1 || !strings.HasPrefix(path, `/`) && !strings.HasPrefix(path, `\`) {
+		return false
+	}
+	ch := host[0]
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z'
 }
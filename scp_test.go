@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestSCPRemote(t *testing.T) {
+	tests := []struct {
+		operand          string
+		user, host, path string
+		ok               bool
+	}{
+		{`www-1:/etc/motd`, ``, `www-1`, `/etc/motd`, true},
+		{`root@www-1:/etc/`, `root`, `www-1`, `/etc/`, true},
+		{`www-*:`, ``, `www-*`, ``, true},
+		{`tag:web:/tmp/`, ``, `tag:web`, `/tmp/`, true},
+		{`root@tag:web:/tmp/`, `root`, `tag:web`, `/tmp/`, true},
+		{`system:www:motd`, ``, `system:www`, `motd`, true},
+		{`host:with:colons`, ``, `host`, `with:colons`, true},
+		{`user@C:/x`, `user`, `C`, `/x`, true},
+		{`motd`, ``, ``, ``, false},
+		{`./a:b`, ``, ``, ``, false},
+		{`/tmp/a:b`, ``, ``, ``, false},
+		{`:motd`, ``, ``, ``, false},
+		{`tag:web`, ``, ``, ``, false},
+		{`C:/x`, ``, ``, ``, false},
+		{`c:\x`, ``, ``, ``, false},
+		{`a@b/c:d`, ``, ``, ``, false},
+	}
+	for _, test := range tests {
+		user, host, path, ok := scpRemote(test.operand)
+		if user != test.user || host != test.host || path != test.path || ok != test.ok {
+			t.Errorf(`scpRemote(%q) = %q, %q, %q, %v, expected %q, %q, %q, %v`, test.operand,
+				user, host, path, ok, test.user, test.host, test.path, test.ok)
+		}
+	}
+}
+
+func TestSCPFirstOperand(t *testing.T) {
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{[]string{`motd`, `www-1:`}, 0},
+		{[]string{`-D`, `/usr/lib/sftp-server`, `motd`, `www-1:`}, 2},
+		{[]string{`-D/usr/lib/sftp-server`, `motd`, `www-1:`}, 1},
+		{[]string{`-X`, `nrequests=8`, `motd`, `www-1:`}, 2},
+		{[]string{`-3`, `-X`, `buffer=65536`, `-r`, `dir`, `www-1:`}, 4},
+		{[]string{`-D`}, -1},
+	}
+	for _, test := range tests {
+		got := firstOperand(test.args, scpOptionArgs)
+		if got != test.want {
+			t.Errorf(`firstOperand(%q) = %v, expected %v`, test.args, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	rf := runCmd.Flags()
+	rf.StringVar(&runScript, `script`, ``, `Local script to copy to each instance and run`)
+	rf.StringVar(&runScriptNix, `script-nix`, ``, `Nix file with a package whose program is run on each instance`)
+	rf.BoolVar(&runSudo, `sudo`, false, `Run the script as root`)
+}
+
+var runScript = ``
+var runScriptNix = ``
+var runSudo = false
+
+// runScriptOn runs the script given by --script or --script-nix on each instance with args, inside the command in
+// prefix, if any, such as the hive-shell of a --shell.
+func runScriptOn(ctx context.Context, user string, instances, prefix, args []string) error {
+	if runScript != `` && runScriptNix != `` {
+		return fmt.Errorf(`only one of --script and --script-nix may be given`)
+	}
+	if runSudo {
+		prefix = append([]string{`sudo`}, prefix...)
+	}
+	if runScriptNix != `` {
+		result, program, err := buildScript(ctx, runScriptNix)
+		if err != nil {
+			return err
+		}
+		err = inv.push(ctx, instances, result)
+		if err != nil {
+			return err
+		}
+		command := shellCommand(append(append(append([]string(nil), prefix...), program), args...))
+		return runOnInstances(ctx, instances,
+			func(ctx context.Context, instance string, stdin io.Reader, stdout, stderr io.Writer) error {
+				return runCommandOn(ctx, joinUser(user, instance), []string{command}, stdin, stdout, stderr)
+			})
+	}
+
+	script, err := ioutil.ReadFile(runScript)
+	if err != nil {
+		return fmt.Errorf(`%w while reading the script`, err)
+	}
+	command := scriptCommand(prefix, args)
+	return runOnInstances(ctx, instances,
+		func(ctx context.Context, instance string, _ io.Reader, stdout, stderr io.Writer) error {
+			destination := joinUser(user, instance)
+			_, err := retry(ctx, `running the script on `+destination, func() error {
+				resetOutput(stdout, stderr)
+				return openSSH(ctx, `ssh`, []string{destination, command}, bytes.NewReader(script), stdout, stderr)
+			})
+			return err
+		})
+}
+
+// scriptCommand returns a shell command that saves a script from stdin and runs it with args, inside the command in
+// prefix.  The script arrives on stdin, so it cannot have any; it is removed even if it fails.
+func scriptCommand(prefix, args []string) string {
+	return `f=$(mktemp) && trap 'rm -f "$f"' EXIT && cat > "$f" && chmod +x "$f" && ` +
+		shellCommand(prefix) + ` "$f" ` + shellCommand(args)
+}
+
+// buildScript builds the package in a Nix file, and returns its result and the path of its program, which must be the
+// only one in its bin directory.
+func buildScript(ctx context.Context, path string) (string, string, error) {
+	result, err := buildFile(ctx, `script`, path, `(import <hive/package.nix>)`)
+	if err != nil {
+		return ``, ``, err
+	}
+	bin := filepath.Join(result, `bin`)
+	entries, err := ioutil.ReadDir(bin)
+	if err != nil {
+		return ``, ``, fmt.Errorf(`%w while looking for the program in %v`, err, path)
+	}
+	if len(entries) != 1 {
+		return ``, ``, fmt.Errorf(`%v has %v programs in bin, but --script-nix needs exactly one`, path, len(entries))
+	}
+	return result, filepath.Join(bin, entries[0].Name()), nil
+}
+
+// shellCommand quotes each word for a shell, and joins them into a command.
+func shellCommand(words []string) string {
+	quoted := make([]string, len(words))
+	for ix, word := range words {
+		quoted[ix] = quoteShell(word)
+	}
+	return strings.Join(quoted, ` `)
+}
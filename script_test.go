@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestScriptCommand(t *testing.T) {
+	if _, err := exec.LookPath(`sh`); err != nil {
+		t.Skip(`sh is not available`)
+	}
+	tests := []struct {
+		prefix []string
+		args   []string
+		want   []string
+	}{
+		{nil, nil, nil},
+		{nil, commandArgs([]string{`--`, `--dry-run`}), []string{`--dry-run`}},
+		{nil, []string{`two words`, `$HOME`, `it's`}, []string{`two words`, `$HOME`, `it's`}},
+		{[]string{`env`}, []string{`-x`, ``}, []string{`-x`, ``}},
+	}
+	const script = "#!/bin/sh\nfor arg in \"$@\"; do echo \"[$arg]\"; done\n"
+	for _, test := range tests {
+		proc := exec.Command(`sh`, `-c`, scriptCommand(test.prefix, test.args))
+		proc.Stdin = strings.NewReader(script)
+		out, err := proc.Output()
+		if err != nil {
+			t.Errorf(`running the script with %q failed: %v`, test.args, err)
+			continue
+		}
+		var got []string
+		for _, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+			if line != `` {
+				got = append(got, strings.TrimSuffix(strings.TrimPrefix(line, `[`), `]`))
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf(`the script got %q for %q, expected %q`, got, test.args, test.want)
+		}
+	}
+}
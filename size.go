@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// byteUnits lists the suffixes understood by parseBytes, with their multipliers.  Both SI-ish suffixes ("M", "MB") and
+// binary suffixes ("MiB") are treated as powers of 1024, which is what Nix prints.
+var byteUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{`TiB`, 1 << 40}, {`GiB`, 1 << 30}, {`MiB`, 1 << 20}, {`KiB`, 1 << 10},
+	{`TB`, 1 << 40}, {`GB`, 1 << 30}, {`MB`, 1 << 20}, {`KB`, 1 << 10},
+	{`T`, 1 << 40}, {`G`, 1 << 30}, {`M`, 1 << 20}, {`K`, 1 << 10},
+	{`B`, 1},
+}
+
+// parseBytes parses a size like "512", "1.5 GiB" or "-20.0 KiB" into bytes.
+func parseBytes(text string) (int64, error) {
+	text = strings.TrimSpace(text)
+	scale := 1.0
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(text, unit.suffix) {
+			text = strings.TrimSpace(strings.TrimSuffix(text, unit.suffix))
+			scale = unit.scale
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return 0, fmt.Errorf(`%q is not a size`, text)
+	}
+	return int64(n * scale), nil
+}
+
+// formatBytes formats a size the way Nix does, using binary units.
+func formatBytes(n int64) string {
+	sign := ``
+	if n < 0 {
+		sign, n = `-`, -n
+	}
+	for _, unit := range byteUnits[:4] {
+		if float64(n) >= unit.scale {
+			return fmt.Sprintf(`%v%.1f %v`, sign, float64(n)/unit.scale, unit.suffix)
+		}
+	}
+	return fmt.Sprintf(`%v%v B`, sign, n)
+}
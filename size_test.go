@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		text string
+		want int64
+		err  bool
+	}{
+		{`512`, 512, false},
+		{`512 B`, 512, false},
+		{`1.5 GiB`, 3 << 29, false},
+		{`-20.0 KiB`, -20480, false},
+		{`2M`, 2 << 20, false},
+		{`2 MB`, 2 << 20, false},
+		{` 1 TiB `, 1 << 40, false},
+		{``, 0, true},
+		{`MiB`, 0, true},
+		{`lots`, 0, true},
+	}
+	for _, test := range tests {
+		got, err := parseBytes(test.text)
+		switch {
+		case test.err && err == nil:
+			t.Errorf(`parseBytes(%q) = %v, expected an error`, test.text, got)
+		case !test.err && err != nil:
+			t.Errorf(`parseBytes(%q) failed: %v`, test.text, err)
+		case got != test.want:
+			t.Errorf(`parseBytes(%q) = %v, expected %v`, test.text, got, test.want)
+		}
+	}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/spf13/cobra"
 )
@@ -16,20 +20,102 @@ func init() {
 var sshCmd = &cobra.Command{
 	Use:   `ssh`,
 	Short: `SSHs to a managed instance`,
-	Long:  `ssh will generate an ssh config and use it with your arguments`,
-	RunE:  runSSH,
+	Long: `ssh will generate an ssh config and use it with your arguments.
+
+The destination may be a pattern, such as "www-*" or "tag:web", optionally preceded by "user@".  An interactive
+session must match a single instance, while a command is run on each matching instance, like "nix-hive run".
+Destinations that do not match any instance are passed to ssh as they are.`,
+	RunE: runSSH,
 }
 
+// sshOptionArgs lists the ssh options that take an argument.
+const sshOptionArgs = `BbcDEeFIiJLlmOopQRSWw`
+
 func runSSH(cmd *cobra.Command, args []string) error {
-	err := generateSshConfig(cmd.Context())
+	ctx := cmd.Context()
+	err := generateSshConfig(ctx)
 	if err != nil {
 		return err
 	}
-	proc := exec.CommandContext(cmd.Context(), `ssh`, append([]string{
+	ix := firstOperand(args, sshOptionArgs)
+	if ix == -1 {
+		return openSSH(ctx, `ssh`, args, os.Stdin, os.Stdout, os.Stderr)
+	}
+	user, pattern := splitUser(args[ix])
+	instances, ok := inv.resolveInstances(pattern)
+	if !ok {
+		return openSSH(ctx, `ssh`, args, os.Stdin, os.Stdout, os.Stderr)
+	}
+	withDestination := func(instance string) []string {
+		return append(append(append([]string(nil), args[:ix]...), joinUser(user, instance)), args[ix+1:]...)
+	}
+	if len(instances) == 1 {
+		return openSSH(ctx, `ssh`, withDestination(instances[0]), os.Stdin, os.Stdout, os.Stderr)
+	}
+	if ix == len(args)-1 {
+		return fmt.Errorf(`%q matches %v instances (%v), but an interactive session needs exactly one`,
+			pattern, len(instances), strings.Join(instances, `, `))
+	}
+	return runOnInstances(ctx, instances,
+		func(ctx context.Context, instance string, stdin io.Reader, stdout, stderr io.Writer) error {
+			return openSSH(ctx, `ssh`, withDestination(instance), stdin, stdout, stderr)
+		})
+}
+
+// openSSH runs ssh or scp with the generated ssh_config.
+func openSSH(ctx context.Context, program string, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	proc := exec.CommandContext(ctx, program, append([]string{
 		`-F`, filepath.Join(tmp, `ssh_config`),
 	}, args...)...)
-	proc.Stdout = os.Stdout
-	proc.Stderr = os.Stderr
-	proc.Stdin = os.Stdin
+	proc.Stdout = stdout
+	proc.Stderr = stderr
+	proc.Stdin = stdin
 	return proc.Run()
 }
+
+// firstOperand returns the index of the first argument that is not an option, or an option's argument, given the
+// letters of the options that take arguments.  It returns -1 if every argument is an option.
+func firstOperand(args []string, optionArgs string) int {
+	for ix := 0; ix < len(args); ix++ {
+		arg := args[ix]
+		switch {
+		case arg == `--`:
+			if ix+1 < len(args) {
+				return ix + 1
+			}
+			return -1
+		case len(arg) < 2 || arg[0] != '-':
+			return ix
+		case len(arg) == 2 && strings.IndexByte(optionArgs, arg[1]) != -1:
+			ix++ // the next argument belongs to the option.
+		}
+	}
+	return -1
+}
+
+// resolveInstances returns the instances matching a pattern, or false if it does not match any, such as a host
+// that is not an instance.
+func (inv *Inventory) resolveInstances(pattern string) ([]string, bool) {
+	instances, err := inv.matchInstances(pattern)
+	if err != nil || len(instances) == 0 {
+		return nil, false
+	}
+	return instances, true
+}
+
+// splitUser splits "user@pattern" into its user and pattern.  The user is empty if there is no "@".
+func splitUser(text string) (string, string) {
+	ix := strings.IndexByte(text, '@')
+	if ix == -1 {
+		return ``, text
+	}
+	return text[:ix], text[ix+1:]
+}
+
+// joinUser joins a user and a host for ssh, if there is a user.
+func joinUser(user, host string) string {
+	if user == `` {
+		return host
+	}
+	return user + `@` + host
+}
@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestFirstOperand(t *testing.T) {
+	tests := []struct {
+		args       []string
+		optionArgs string
+		want       int
+	}{
+		{[]string{`www-1`}, sshOptionArgs, 0},
+		{[]string{`www-1`, `uptime`}, sshOptionArgs, 0},
+		{[]string{`-v`, `www-1`}, sshOptionArgs, 1},
+		{[]string{`-l`, `root`, `www-1`, `-v`}, sshOptionArgs, 2},
+		{[]string{`-p22`, `www-1`}, sshOptionArgs, 1},
+		{[]string{`-o`, `BatchMode=yes`, `-tt`, `www-1`}, sshOptionArgs, 3},
+		{[]string{`-v`, `--`, `-weird-host`}, sshOptionArgs, 2},
+		{[]string{`-v`, `--`}, sshOptionArgs, -1},
+		{[]string{`-l`, `root`}, sshOptionArgs, -1},
+		{[]string{`-V`}, sshOptionArgs, -1},
+		{nil, sshOptionArgs, -1},
+		{[]string{`-`, `www-1`}, sshOptionArgs, 0},
+		{[]string{`-P`, `2222`, `motd`, `www-1:`}, scpOptionArgs, 2},
+		{[]string{`-r`, `-i`, `key`, `dir`, `www-1:`}, scpOptionArgs, 3},
+	}
+	for _, test := range tests {
+		got := firstOperand(test.args, test.optionArgs)
+		if got != test.want {
+			t.Errorf(`firstOperand(%q) = %v, expected %v`, test.args, got, test.want)
+		}
+	}
+}
+
+func TestSplitUser(t *testing.T) {
+	tests := []struct {
+		text, user, pattern string
+	}{
+		{`www-1`, ``, `www-1`},
+		{`root@www-*`, `root`, `www-*`},
+		{`root@tag:web`, `root`, `tag:web`},
+		{`@www-1`, ``, `www-1`},
+	}
+	for _, test := range tests {
+		user, pattern := splitUser(test.text)
+		if user != test.user || pattern != test.pattern {
+			t.Errorf(`splitUser(%q) = %q, %q, expected %q, %q`, test.text, user, pattern, test.user, test.pattern)
+		}
+		if test.user != `` && joinUser(user, pattern) != test.text {
+			t.Errorf(`joinUser(%q, %q) = %q, expected %q`, user, pattern, joinUser(user, pattern), test.text)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(throttleCmd)
+	skipInventory(throttleCmd)
+}
+
+// throttleCmd wraps ssh for "nix copy" when pushes have bandwidth limits.  Nix runs "ssh" from the PATH, which is a
+// script that runs this command, which runs the real ssh with its input metered by the Nix-Hive process that started
+// the copy.
+var throttleCmd = &cobra.Command{
+	Use:                `throttle ssh-args...`,
+	Short:              `Runs ssh with a limit on the bandwidth it uses`,
+	Hidden:             true,
+	DisableFlagParsing: true,
+	RunE:               runThrottle,
+}
+
+// throttleBuffer is the most that is sent between requests for bandwidth.
+const throttleBuffer = 32 << 10
+
+// throttleSocket is the socket where Nix-Hive meters bandwidth for throttled ssh processes, while a push is running.
+var throttleSocket = ``
+
+func runThrottle(cmd *cobra.Command, args []string) error {
+	conn, err := net.Dial(`unix`, os.Getenv(`NIX_HIVE_THROTTLE`))
+	if err != nil {
+		return fmt.Errorf(`%w while connecting to nix-hive for a bandwidth limit`, err)
+	}
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "%v\n", os.Getenv(`NIX_HIVE_THROTTLE_KEY`))
+	if err != nil {
+		return err
+	}
+
+	proc := exec.Command(os.Getenv(`NIX_HIVE_SSH`), args...)
+	proc.Stdout = os.Stdout
+	proc.Stderr = os.Stderr
+	stdin, err := proc.StdinPipe()
+	if err != nil {
+		return err
+	}
+	err = proc.Start()
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer stdin.Close()
+		grants := bufio.NewReader(conn)
+		buf := make([]byte, throttleBuffer)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				_, err := fmt.Fprintf(conn, "%v\n", n)
+				if err == nil {
+					_, err = grants.ReadString('\n')
+				}
+				if err == nil {
+					_, err = stdin.Write(buf[:n])
+				}
+				if err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	err = proc.Wait()
+	if exit, ok := err.(*exec.ExitError); ok {
+		exitCode = exit.ExitCode() // so 255 still means that ssh could not connect.
+		return nil
+	}
+	return err
+}
+
+// A transferLimit limits the pushes to a store and the instances that use it.
+type transferLimit struct {
+	// name is the name of the store.
+	name string
+
+	// slots has room for as many pushes as may run at once, or is nil if there is no limit.
+	slots chan struct{}
+
+	// rate limits the bandwidth of the pushes, and is nil if there is no limit.
+	rate *rateLimiter
+}
+
+type transferKey struct{}
+
+// withTransferLimit returns a context for a push that is subject to limit, which may be nil.
+func withTransferLimit(ctx context.Context, limit *transferLimit) context.Context {
+	return context.WithValue(ctx, transferKey{}, limit)
+}
+
+// transferLimits returns the limits for each store that has them, by store URL.
+func (inv *Inventory) transferLimits(ctx context.Context) map[string]*transferLimit {
+	limits := make(map[string]*transferLimit)
+	for name, store := range inv.Stores {
+		if store.Bandwidth <= 0 && store.Connections <= 0 {
+			continue
+		}
+		limit := &transferLimit{name: name}
+		if store.Connections > 0 {
+			limit.slots = make(chan struct{}, store.Connections)
+		}
+		if store.Bandwidth > 0 {
+			limit.rate = newRateLimiter(int64(store.Bandwidth))
+			if !isSSHStore(store.URL) {
+				warn(ctx, `store %q does not use SSH, so its bandwidth only limits pushes to its instances`, name)
+			}
+		}
+		limits[store.storeURL()] = limit
+	}
+	return limits
+}
+
+// startThrottle starts metering the bandwidth of pushes over SSH, if the deployment or any of the limits have a
+// bandwidth limit, and returns a function that stops it.
+func (inv *Inventory) startThrottle(ctx context.Context, limits map[string]*transferLimit) (func(), error) {
+	rates := make(map[string]*rateLimiter)
+	for _, limit := range limits {
+		if limit.rate != nil {
+			rates[limit.name] = limit.rate
+		}
+	}
+	if inv.Bandwidth <= 0 && len(rates) == 0 {
+		return func() {}, nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	ssh, err := exec.LookPath(`ssh`)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(tmp, `throttle`)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	script := fmt.Sprintf("#!/bin/sh\nexport NIX_HIVE_SSH=%v\nexec %v throttle \"$@\"\n",
+		quoteShell(ssh), quoteShell(exe))
+	err = ioutil.WriteFile(filepath.Join(dir, `ssh`), []byte(script), 0700)
+	if err != nil {
+		return nil, err
+	}
+	sock := filepath.Join(dir, `socket`)
+	ln, err := net.Listen(`unix`, sock)
+	if err != nil {
+		return nil, err
+	}
+	global := newRateLimiter(int64(inv.Bandwidth))
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return // closed.
+			}
+			go meterBandwidth(ctx, conn, global, rates)
+		}
+	}()
+	throttleSocket = sock
+	return func() {
+		throttleSocket = ``
+		ln.Close()
+	}, nil
+}
+
+// meterBandwidth grants bandwidth to a throttled ssh process, which asks for each block of bytes before sending it.
+func meterBandwidth(ctx context.Context, conn net.Conn, global *rateLimiter, rates map[string]*rateLimiter) {
+	defer conn.Close()
+	requests := bufio.NewReader(conn)
+	key, err := requests.ReadString('\n')
+	if err != nil {
+		return
+	}
+	rate := rates[strings.TrimSpace(key)]
+	for {
+		line, err := requests.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+		if err != nil {
+			return
+		}
+		if global.wait(ctx, n) != nil || rate.wait(ctx, n) != nil {
+			return
+		}
+		_, err = io.WriteString(conn, "\n")
+		if err != nil {
+			return
+		}
+	}
+}
+
+// throttleEnv adds the environment that throttles a copy to a store over SSH to env, if pushes are being metered.
+func throttleEnv(ctx context.Context, store string, env []string) []string {
+	if throttleSocket == `` || !isSSHStore(store) {
+		return env
+	}
+	key := ``
+	if limit, ok := ctx.Value(transferKey{}).(*transferLimit); ok && limit != nil {
+		key = limit.name
+	}
+	return append(env,
+		`PATH=`+filepath.Dir(throttleSocket)+string(os.PathListSeparator)+os.Getenv(`PATH`),
+		`NIX_HIVE_THROTTLE=`+throttleSocket,
+		`NIX_HIVE_THROTTLE_KEY=`+key)
+}
+
+// quoteShell quotes a string for sh.
+func quoteShell(text string) string {
+	return `'` + strings.ReplaceAll(text, `'`, `'\''`) + `'`
+}
+
+// A rateLimiter spaces out requests for bytes so that, together, they do not exceed a rate.  A nil rateLimiter
+// does not limit anything.
+type rateLimiter struct {
+	sync.Mutex
+	rate int64
+	next time.Time
+}
+
+// newRateLimiter returns a limiter for a number of bytes per second, or nil if the rate is not positive.
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate}
+}
+
+// wait waits until n bytes may be sent.
+func (l *rateLimiter) wait(ctx context.Context, n int64) error {
+	if l == nil {
+		return nil
+	}
+	l.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(time.Duration(n * int64(time.Second) / l.rate))
+	l.Unlock()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Until(at)):
+		return nil
+	}
+}